@@ -1,3 +1,7 @@
 export GOPATH=$PWD
-go get code.google.com/p/go.net/websocket
+go get github.com/gorilla/websocket
+go get github.com/vmihailenco/msgpack/v5
+go get github.com/fxamacker/cbor/v2
+go get gopkg.in/yaml.v3
+go get github.com/BurntSushi/toml
 go build github.com/zeljkokunica/comet_server
\ No newline at end of file
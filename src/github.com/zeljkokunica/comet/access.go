@@ -0,0 +1,196 @@
+package comet
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+/**
+* keys clients send as key parameter or "Authorization: Bearer <key>" header
+* publish keys also allow everything subscribe keys allow, admin keys allow everything
+* empty key list leaves its commands open only while lower levels have no keys either,
+* so publish keys alone keep subscribing open but close reload
+*/
+type AuthConfig struct {
+	// subscribing, receiving data and client commands (requests, replies, client publish, backend routes)
+	SubscribeKeys []string `json:"subscribeKeys" yaml:"subscribeKeys" toml:"subscribeKeys"`
+	// create, update, clear, configure and scheduled publishes
+	PublishKeys []string `json:"publishKeys" yaml:"publishKeys" toml:"publishKeys"`
+	// reload
+	AdminKeys []string `json:"adminKeys" yaml:"adminKeys" toml:"adminKeys"`
+}
+
+const (
+	accessOpen = 0
+	accessSubscribe = 1
+	accessPublish = 2
+	accessAdmin = 3
+)
+
+/**
+* auth keys and allowed origins, changed while hub is running
+*/
+type hubAccess struct {
+	lock sync.RWMutex
+	auth AuthConfig
+	// "*" allows every origin
+	allowedOrigins []string
+}
+
+func newHubAccess() *hubAccess {
+	return &hubAccess{allowedOrigins: []string{"*"}}
+}
+
+/**
+* replaces auth keys of running hub
+*/
+func (h *Hub) SetAuth(auth AuthConfig) {
+	h.access.lock.Lock()
+	defer h.access.lock.Unlock()
+	h.access.auth = auth
+}
+
+/**
+* replaces origins allowed to make cross origin http requests and open web sockets, "*" allows all
+*/
+func (h *Hub) SetAllowedOrigins(origins []string) {
+	h.access.lock.Lock()
+	defer h.access.lock.Unlock()
+	h.access.allowedOrigins = append([]string(nil), origins...)
+}
+
+/**
+* access level needed by http command
+* files of web root (commands with extension, not matching a backend route) are open, so pages can load the client
+*/
+func (h *Hub) commandAccessLevel(command string) int {
+	switch command {
+		case DataCreate, DataUpdate, DataClear, DataConfigure, "scheduled", "cancelscheduled":
+			return accessPublish
+		case "reload":
+			return accessAdmin
+	}
+	if route, _ := h.backendRoutes.match(command); route == nil && path.Ext(command) != "" {
+		return accessOpen
+	}
+	return accessSubscribe
+}
+
+/**
+* key of request - key parameter, or bearer token of http request
+*/
+func requestKey(m DataMediator) string {
+	if key := m.ReadParameter("key"); key != "" {
+		return key
+	}
+	if headers, ok := m.(interface{ ReadHeader(string) string }); ok {
+		var authorization = headers.ReadHeader("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		}
+	}
+	return ""
+}
+
+/**
+* copy of request parameters for logging - key is not logged
+*/
+func redactedForm(form url.Values) url.Values {
+	var redacted = make(url.Values, len(form))
+	for name, values := range(form) {
+		if name == "key" {
+			values = []string{"redacted"}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+/**
+* copy of web socket command parameters for logging - key is not logged
+*/
+func redactedParameters(parameters map[string]interface{}) map[string]interface{} {
+	var redacted = make(map[string]interface{}, len(parameters))
+	for name, value := range(parameters) {
+		if name == "key" {
+			value = "redacted"
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+func containsKey(keys []string, key string) bool {
+	var found = false
+	for _, candidate := range(keys) {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+/**
+* returns false and writes 401 response if request key does not allow access level
+*/
+func (h *Hub) authorize(level int, m DataMediator) bool {
+	h.access.lock.RLock()
+	var auth = h.access.auth
+	h.access.lock.RUnlock()
+	if level == accessOpen {
+		return true
+	}
+	// keys by access level, keys of higher levels allow lower levels
+	var levels = [][]string{auth.SubscribeKeys, auth.PublishKeys, auth.AdminKeys}
+	var keys = levels[level - 1:]
+	var secured = false
+	for _, lower := range(levels[:level]) {
+		secured = secured || len(lower) > 0
+	}
+	if !secured {
+		return true
+	}
+	var key = requestKey(m)
+	for _, allowed := range(keys) {
+		if key != "" && containsKey(allowed, key) {
+			return true
+		}
+	}
+	m.WriteError(http.StatusUnauthorized, "missing or invalid key")
+	return false
+}
+
+/**
+* Access-Control-Allow-Origin value for origin, empty if origin is not allowed
+*/
+func (h *Hub) allowedOrigin(origin string) string {
+	h.access.lock.RLock()
+	defer h.access.lock.RUnlock()
+	for _, allowed := range(h.access.allowedOrigins) {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+/**
+* jsonp responses can be read by scripts of any page, bypassing cors - with restricted origins
+* callback is served only to pages of allowed origins, taken from Origin or Referer header
+*/
+func (h *Hub) allowedJsonpOrigin(r *http.Request) bool {
+	var origin = r.Header.Get("Origin")
+	if origin == "" {
+		if referer, err := url.Parse(r.Header.Get("Referer")); err == nil && referer.Scheme != "" && referer.Host != "" {
+			origin = referer.Scheme + "://" + referer.Host
+		}
+	}
+	return h.allowedOrigin(origin) != ""
+}
@@ -0,0 +1,98 @@
+package comet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoggedParametersHideKey(t *testing.T) {
+	var form = url.Values{"key": {"secret"}, "channel": {"news"}}
+	var logged = redactedForm(form).Encode()
+	if strings.Contains(logged, "secret") || !strings.Contains(logged, "channel=news") {
+		t.Errorf("logged form %s", logged)
+	}
+	if form.Get("key") != "secret" {
+		t.Error("request form changed")
+	}
+	var parameters = redactedParameters(map[string]interface{}{"key": "secret", "channel": "news"})
+	if parameters["key"] == "secret" || parameters["channel"] != "news" {
+		t.Errorf("logged parameters %v", parameters)
+	}
+}
+
+func testAuthorize(hub *Hub, level int, key string) bool {
+	var request = httptest.NewRequest("GET", "/command?key=" + url.QueryEscape(key), nil)
+	request.ParseForm()
+	return hub.authorize(level, &HttpDataMediator{w: httptest.NewRecorder(), r: request, codec: JsonCodec})
+}
+
+/**
+* levels without keys stay open only while no lower level has keys
+*/
+func TestAuthorizeClosesLevelsAboveKeys(t *testing.T) {
+	var hub = newTestHub(t)
+	for _, level := range([]int{accessSubscribe, accessPublish, accessAdmin}) {
+		if !testAuthorize(hub, level, "") {
+			t.Errorf("level %d closed without keys", level)
+		}
+	}
+	hub.SetAuth(AuthConfig{PublishKeys: []string{"publisher"}})
+	var expected = []struct {
+		level int
+		key string
+		allowed bool
+	}{
+		{accessSubscribe, "", true},
+		{accessPublish, "", false},
+		{accessPublish, "publisher", true},
+		{accessAdmin, "", false},
+		{accessAdmin, "publisher", false},
+	}
+	for _, check := range(expected) {
+		if allowed := testAuthorize(hub, check.level, check.key); allowed != check.allowed {
+			t.Errorf("level %d with key '%s' allowed %v, expected %v", check.level, check.key, allowed, check.allowed)
+		}
+	}
+	hub.SetAuth(AuthConfig{SubscribeKeys: []string{"subscriber"}, AdminKeys: []string{"admin"}})
+	if testAuthorize(hub, accessPublish, "subscriber") || !testAuthorize(hub, accessPublish, "admin") {
+		t.Error("publishing without publish keys must need admin key")
+	}
+}
+
+/**
+* jsonp responses bypass cors - with restricted origins callback needs allowed Origin or Referer
+*/
+func TestJsonpFollowsAllowedOrigins(t *testing.T) {
+	var hub = newTestHub(t)
+	var subscribe = func(header string, value string) int {
+		var request = httptest.NewRequest("GET", "/subscribe?channels=news&callback=cb", nil)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		var recorder = httptest.NewRecorder()
+		hub.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	if code := subscribe("", ""); code != http.StatusOK {
+		t.Errorf("jsonp with all origins allowed returned %d", code)
+	}
+	hub.SetAllowedOrigins([]string{"https://app.example"})
+	for _, check := range([]struct {
+		header string
+		value string
+		code int
+	}{
+		{"", "", http.StatusForbidden},
+		{"Referer", "https://evil.example/page", http.StatusForbidden},
+		{"Origin", "https://evil.example", http.StatusForbidden},
+		{"Referer", "https://app.example/page?x=1", http.StatusOK},
+		{"Origin", "https://app.example", http.StatusOK},
+	}) {
+		if code := subscribe(check.header, check.value); code != check.code {
+			t.Errorf("jsonp with %s '%s' returned %d, expected %d", check.header, check.value, code, check.code)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package comet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* command prefix proxied to an http upstream
+* url and header values are templates: {path} is command after prefix, {name} is request parameter name
+* values are escaped in url (path per segment), path with . or .. segment is rejected
+* publisher id of requesting subscriber is sent in X-Comet-Publisher-Id header, correlationId in X-Comet-Correlation-Id
+* with Progress, each line of upstream response except the last one is sent to requester's private channel
+* as progress command, the last line is the response
+*/
+type BackendRoute struct {
+	Prefix string `json:"prefix"`
+	Method string `json:"method"`
+	Url string `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// milliseconds, BackendTimeout of hub config when not set
+	Timeout int64 `json:"timeout"`
+	Progress bool `json:"progress"`
+}
+
+/**
+* progress command sent to requester's private channel for routes with progress
+*/
+const ProgressCommand = "progress"
+
+var backendTemplatePattern = regexp.MustCompile(`\{([A-Za-z0-9_\-]+)\}`)
+
+/**
+* configured backend routes, longest prefix first
+*/
+type backendRoutes struct {
+	lock sync.RWMutex
+	routes []BackendRoute
+	client *http.Client
+}
+
+func newBackendRoutes() *backendRoutes {
+	return &backendRoutes{routes: make([]BackendRoute, 0), client: &http.Client{}}
+}
+
+/**
+* route for command and rest of the command after route prefix
+*/
+func (b *backendRoutes) match(command string) (*BackendRoute, string) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for i := range(b.routes) {
+		var prefix = b.routes[i].Prefix
+		if command == prefix || strings.HasPrefix(command, prefix + "/") {
+			var route = b.routes[i]
+			return &route, strings.TrimPrefix(command[len(prefix):], "/")
+		}
+	}
+	return nil, ""
+}
+
+/**
+* replaces backend routes of running hub
+*/
+func (h *Hub) SetBackendRoutes(routes []BackendRoute) error {
+	var sorted = make([]BackendRoute, 0, len(routes))
+	for _, route := range(routes) {
+		route.Prefix = strings.Trim(route.Prefix, "/")
+		if route.Prefix == "" {
+			return newHubError(http.StatusBadRequest, "backend route without prefix")
+		}
+		if route.Method == "" {
+			route.Method = "GET"
+		}
+		route.Method = strings.ToUpper(route.Method)
+		if upstream, err := url.Parse(backendTemplatePattern.ReplaceAllString(route.Url, "x")); err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") {
+			return newHubError(http.StatusBadRequest, "backend route %s has invalid url '%s'", route.Prefix, route.Url)
+		}
+		sorted = append(sorted, route)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+	h.backendRoutes.lock.Lock()
+	defer h.backendRoutes.lock.Unlock()
+	h.backendRoutes.routes = sorted
+	return nil
+}
+
+/**
+* http client used for upstream requests
+*/
+func (h *Hub) SetBackendClient(client *http.Client) {
+	h.backendRoutes.lock.Lock()
+	defer h.backendRoutes.lock.Unlock()
+	h.backendRoutes.client = client
+}
+
+/**
+* fills {name} placeholders, escape is applied to parameter values - path is escaped by caller
+*/
+func expandBackendTemplate(template string, path string, m DataMediator, escape func(string) string) string {
+	return backendTemplatePattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		var name = placeholder[1:len(placeholder) - 1]
+		if name == "path" {
+			return path
+		}
+		return escape(m.ReadParameter(name))
+	})
+}
+
+/**
+* escapes each segment of path, so path can not leave route's url or add query
+*/
+func escapeBackendPath(path string) string {
+	var segments = strings.Split(path, "/")
+	for i := range(segments) {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func backendUrl(route *BackendRoute, path string, m DataMediator) (string, error) {
+	for _, segment := range(strings.Split(path, "/")) {
+		if segment == "." || segment == ".." {
+			return "", newHubError(http.StatusBadRequest, "invalid path '%s'", path)
+		}
+	}
+	var parts = strings.SplitN(route.Url, "?", 2)
+	var result = expandBackendTemplate(parts[0], escapeBackendPath(path), m, url.PathEscape)
+	if len(parts) > 1 {
+		result += "?" + expandBackendTemplate(parts[1], url.QueryEscape(path), m, url.QueryEscape)
+	}
+	return result, nil
+}
+
+/**
+* proxies command to route's upstream, upstream response is written as command response
+* parameters: id - subscriber (for progress), correlationId - sent with progress commands, data - request body
+*/
+func (h *Hub) onBackendRequest(route *BackendRoute, path string, m DataMediator) {
+	var body io.Reader
+	var contentType string
+	if route.Method == "POST" || route.Method == "PUT" || route.Method == "PATCH" {
+		data, err := readData(m)
+		if err == nil {
+			err = h.validateDataSize(data)
+		}
+		if err != nil {
+			writeHubError(m, err)
+			return
+		}
+		body = strings.NewReader(data)
+		contentType = "text/plain; charset=utf-8"
+		if json.Valid([]byte(data)) {
+			contentType = "application/json"
+		}
+	}
+	var timeout = h.config.BackendTimeout
+	if route.Timeout > 0 {
+		timeout = time.Duration(route.Timeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	upstreamUrl, err := backendUrl(route, path, m)
+	if err != nil {
+		writeHubError(m, err)
+		return
+	}
+	request, err := http.NewRequestWithContext(ctx, route.Method, upstreamUrl, body)
+	if err != nil {
+		m.WriteError(http.StatusBadGateway, "invalid upstream request: " + err.Error())
+		return
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range(route.Headers) {
+		request.Header.Set(name, expandBackendTemplate(value, path, m, func(value string) string { return value }))
+	}
+	// subscriber id authorizes requests of the subscriber - upstream gets publisher id, as other subscribers do
+	var subscriberId string
+	if subscriber, found := h.touchSubscriber(m.ReadParameter("id")); found {
+		subscriberId = subscriber.id
+		request.Header.Set("X-Comet-Publisher-Id", subscriber.publisherId)
+	}
+	var correlationId = m.ReadParameter("correlationId")
+	if correlationId != "" {
+		request.Header.Set("X-Comet-Correlation-Id", correlationId)
+	}
+	h.backendRoutes.lock.RLock()
+	var client = h.backendRoutes.client
+	h.backendRoutes.lock.RUnlock()
+	response, err := client.Do(request)
+	if err != nil {
+		l.Wf("backend %s - upstream request failed: %s", route.Prefix, err.Error())
+		if ctx.Err() == context.DeadlineExceeded {
+			m.WriteError(http.StatusGatewayTimeout, "upstream timed out")
+		} else {
+			m.WriteError(http.StatusBadGateway, "upstream not available")
+		}
+		return
+	}
+	defer response.Body.Close()
+	var result []byte
+	if route.Progress && response.StatusCode < 300 {
+		result, err = h.readBackendProgress(response.Body, subscriberId, correlationId)
+	} else {
+		result, err = ioutil.ReadAll(io.LimitReader(response.Body, int64(h.config.MaxDataSize) + 1))
+	}
+	if err == nil && len(result) > h.config.MaxDataSize {
+		err = newHubError(http.StatusBadGateway, "upstream response larger than %d bytes", h.config.MaxDataSize)
+	}
+	if err != nil {
+		l.Wf("backend %s - error reading upstream response: %s", route.Prefix, err.Error())
+		if ctx.Err() == context.DeadlineExceeded {
+			m.WriteError(http.StatusGatewayTimeout, "upstream timed out")
+		} else if hubError, ok := err.(*HubError); ok {
+			writeHubError(m, hubError)
+		} else {
+			m.WriteError(http.StatusBadGateway, "error reading upstream response")
+		}
+		return
+	}
+	if response.StatusCode >= 400 {
+		m.WriteError(response.StatusCode, strings.TrimSpace(string(result)))
+		return
+	}
+	var mediaType = strings.ToLower(strings.TrimSpace(strings.Split(response.Header.Get("Content-Type"), ";")[0]))
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || mediaType == "application/x-ndjson" {
+		var value interface{}
+		var decoder = json.NewDecoder(bytes.NewReader(result))
+		decoder.UseNumber()
+		if decoder.Decode(&value) == nil {
+			m.WriteResponse(value, "json")
+			return
+		}
+	}
+	m.WriteResponse(string(result), "plain")
+}
+
+/**
+* sends every line except the last one as progress to subscriber's private channel, returns the last line
+* progress is delivered with subscriber data, so the last progress may arrive after the response
+*/
+func (h *Hub) readBackendProgress(body io.Reader, subscriberId string, correlationId string) ([]byte, error) {
+	var scanner = bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 4096), h.config.MaxDataSize + 1)
+	var last []byte
+	for scanner.Scan() {
+		if last != nil && subscriberId != "" {
+			h.sendToChannel(ProgressCommand, privateChannelName(subscriberId), string(last), correlationId, "")
+		}
+		last = append([]byte(nil), scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, newHubError(http.StatusBadGateway, "upstream response line larger than %d bytes", h.config.MaxDataSize)
+		}
+		return nil, err
+	}
+	return last, nil
+}
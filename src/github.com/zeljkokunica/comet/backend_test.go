@@ -0,0 +1,185 @@
+package comet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+* request received by test upstream
+*/
+type upstreamRequest struct {
+	method string
+	path string
+	query string
+	header http.Header
+	body string
+}
+
+/**
+* hub server with backend routes to upstream handler, requests seen by upstream are sent to returned channel
+*/
+func newTestBackend(t *testing.T, routes []BackendRoute, handler http.HandlerFunc) (*Hub, string, chan upstreamRequest) {
+	var requests = make(chan upstreamRequest, 10)
+	var upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- upstreamRequest{r.Method, r.URL.Path, r.URL.RawQuery, r.Header, string(body)}
+		handler(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	var hub = newTestHub(t)
+	for i := range(routes) {
+		routes[i].Url = strings.Replace(routes[i].Url, "{upstream}", upstream.URL, 1)
+	}
+	if err := hub.SetBackendRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	var server = httptest.NewServer(hub)
+	t.Cleanup(server.Close)
+	return hub, server.URL, requests
+}
+
+func getTestBackend(t *testing.T, url string) (int, string) {
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body)
+}
+
+func TestBackendMethodAndBody(t *testing.T) {
+	_, url, requests := newTestBackend(t, []BackendRoute{{Prefix: "orders", Method: "post", Url: "{upstream}/orders"}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 7}`))
+	})
+	response, err := http.PostForm(url + "/orders", map[string][]string{"data": {`{"item": "book"}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	var request = <- requests
+	if request.method != "POST" || request.body != `{"item": "book"}` || request.header.Get("Content-Type") != "application/json" {
+		t.Errorf("upstream received %s %s (%s), expected json post", request.method, request.body, request.header.Get("Content-Type"))
+	}
+	var result map[string]interface{}
+	if err = json.Unmarshal(body, &result); err != nil || result["id"] != 7.0 {
+		t.Errorf("response %s, expected upstream json", body)
+	}
+}
+
+func TestBackendPathTemplate(t *testing.T) {
+	_, url, requests := newTestBackend(t, []BackendRoute{{Prefix: "api", Url: "{upstream}/v1/{path}?q={path}&user={user}"}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	if status, body := getTestBackend(t, url + "/api/items/a%20b%3Fadmin=1?user=x%26y"); status != http.StatusOK || body != "ok" {
+		t.Fatalf("status %d %s, expected ok", status, body)
+	}
+	var request = <- requests
+	if request.path != "/v1/items/a b?admin=1" {
+		t.Errorf("upstream path %s, expected escaped path segments", request.path)
+	}
+	if request.query != "q=items%2Fa+b%3Fadmin%3D1&user=x%26y" {
+		t.Errorf("upstream query %s, expected escaped path and user", request.query)
+	}
+	for _, path := range([]string{"/api/items/..%2F..%2Fadmin", "/api/.%2Fitems"}) {
+		if status, _ := getTestBackend(t, url + path); status != http.StatusBadRequest {
+			t.Errorf("status %d for %s, expected %d", status, path, http.StatusBadRequest)
+		}
+	}
+	select {
+		case request = <- requests:
+			t.Errorf("upstream received %s for path with dot segments", request.path)
+		default:
+	}
+}
+
+func TestBackendHeaders(t *testing.T) {
+	hub, url, requests := newTestBackend(t, []BackendRoute{{Prefix: "api", Url: "{upstream}/", Headers: map[string]string{"Authorization": "Bearer {token}", "X-Path": "{path}"}}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	getTestBackend(t, url + "/api/items/1?token=secret&correlationId=c1&id=" + subscriber.id)
+	var request = <- requests
+	var expected = map[string]string{"Authorization": "Bearer secret", "X-Path": "items/1", "X-Comet-Correlation-Id": "c1", "X-Comet-Publisher-Id": subscriber.publisherId}
+	for name, value := range(expected) {
+		if request.header.Get(name) != value {
+			t.Errorf("upstream header %s: %s, expected %s", name, request.header.Get(name), value)
+		}
+	}
+	// subscriber id works as credential of the subscriber, upstream must not see it
+	for name, values := range(request.header) {
+		for _, value := range(values) {
+			if strings.Contains(value, subscriber.id) {
+				t.Errorf("upstream header %s carries subscriber id", name)
+			}
+		}
+	}
+	getTestBackend(t, url + "/api/items/1?id=unknown")
+	if request = <- requests; request.header.Get("X-Comet-Publisher-Id") != "" {
+		t.Errorf("unknown subscriber sent publisher id %s", request.header.Get("X-Comet-Publisher-Id"))
+	}
+}
+
+func TestBackendTimeout(t *testing.T) {
+	var release = make(chan bool)
+	defer close(release)
+	_, url, _ := newTestBackend(t, []BackendRoute{{Prefix: "slow", Url: "{upstream}/", Timeout: 50}}, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <- release:
+			case <- time.After(5 * time.Second):
+		}
+	})
+	var start = time.Now()
+	if status, _ := getTestBackend(t, url + "/slow"); status != http.StatusGatewayTimeout {
+		t.Errorf("status %d, expected %d", status, http.StatusGatewayTimeout)
+	}
+	if time.Since(start) > 2 * time.Second {
+		t.Errorf("timed out after %s, expected route timeout", time.Since(start))
+	}
+}
+
+func TestBackendErrorStatus(t *testing.T) {
+	_, url, _ := newTestBackend(t, []BackendRoute{{Prefix: "api", Url: "{upstream}/"}}, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "item missing", http.StatusNotFound)
+	})
+	status, body := getTestBackend(t, url + "/api/items/1")
+	var response ErrorResponse
+	json.Unmarshal([]byte(body), &response)
+	if status != http.StatusNotFound || response.Code != http.StatusNotFound || response.Error != "item missing" {
+		t.Errorf("status %d %s, expected upstream error 404", status, body)
+	}
+}
+
+func TestBackendProgress(t *testing.T) {
+	hub, url, _ := newTestBackend(t, []BackendRoute{{Prefix: "job", Url: "{upstream}/", Progress: true}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("10%\n50%\ndone"))
+	})
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	if status, body := getTestBackend(t, url + "/job?correlationId=c1&id=" + subscriber.id); status != http.StatusOK || body != "done" {
+		t.Fatalf("status %d %s, expected last line done", status, body)
+	}
+	var progress = make([]string, 0)
+	for len(progress) < 2 {
+		for _, command := range(receiveTestFeed(t, subscriber, privateChannelName(subscriber.id))) {
+			if command.Command == DataCreate {
+				// snapshot of private channel
+				continue
+			}
+			if command.Command != ProgressCommand || command.CorrelationId != "c1" {
+				t.Fatalf("private channel received %v, expected progress of c1", command)
+			}
+			progress = append(progress, command.Data)
+		}
+	}
+	if strings.Join(progress, ",") != "10%,50%" {
+		t.Errorf("progress %v, expected 10%% and 50%%", progress)
+	}
+}
@@ -2,23 +2,81 @@ package comet
 
 import (
 	"time"
+	"encoding/base64"
 	"encoding/json"
+	"strings"
 )
 
+/**
+* channel settings declared with configure request
+*/
+type ChannelOptions struct {
+	// content type of channel data - data of binary channels is base64 encoded in json
+	ContentType string `json:"contentType,omitempty"`
+	// subscribers of channel are tracked and join/leave events are sent to the channel
+	Presence bool `json:"presence,omitempty"`
+	// subscribers may publish to channel over web socket
+	ClientPublish bool `json:"clientPublish,omitempty"`
+	// dispatch policy of queue channel (roundrobin, leastloaded) - published items go to one subscriber each
+	Queue string `json:"queue,omitempty"`
+}
+
+/**
+* text content types are sent as they are, everything else is treated as binary
+*/
+func isBinaryContentType(contentType string) bool {
+	var mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" || strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return false
+	}
+	switch mediaType {
+		case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+			return false
+	}
+	return true
+}
+
+func (o ChannelOptions) IsBinary() bool {
+	return isBinaryContentType(o.ContentType)
+}
+
+/**
+* updates kept by channels - older updates are folded into channel data
+* zero values keep all updates
+*/
+type ChannelRetention struct {
+	MaxUpdates int
+	MaxAge time.Duration
+}
+
 type ChannelData struct {
 	ChannelName string `json:"channelName"`
 	DataVersion int64 `json:"dataVersion"`
 	Data string `json:"data"`
 	DataTime time.Time `json:"dataTime"`
+	// publisher id of client which published the data
+	Publisher string `json:"publisher,omitempty"`
 }
 
 func (cd ChannelData) Copy() ChannelData {
-	return ChannelData{cd.ChannelName, cd.DataVersion, cd.Data, cd.DataTime}
+	return ChannelData{cd.ChannelName, cd.DataVersion, cd.Data, cd.DataTime, cd.Publisher}
 }
 
 type ChannelDataOperation struct {
 	operation DataOperation
 	channelData ChannelData
+	contentType string
+	// data is not sent back to its publisher
+	noEcho bool
+	// request/reply correlation id of transient request, reply and error commands
+	correlationId string
+	// only this subscriber receives the command (queue items)
+	subscriberId string
+	// dispatch policy when data was published to a queue channel
+	queue string
+	// channel options after configure
+	options ChannelOptions
+	err error
 }
 
 /**
@@ -30,12 +88,52 @@ type Channel struct {
 	Data string `json:"data"`
 	DataTime time.Time `json:"dataTime"`
 	Updates []ChannelData `json:"updates"`
+	Options ChannelOptions `json:"options"`
 }
 
 func (c Channel) Copy() Channel {
 	updates := make([]ChannelData, len(c.Updates))
 	copy(updates, c.Updates)
-	return Channel{c.ChannelName, c.DataVersion, c.Data, c.DataTime, updates}
+	return Channel{c.ChannelName, c.DataVersion, c.Data, c.DataTime, updates, c.Options}
+}
+
+type channelJson Channel
+
+/**
+* data of binary channels is stored base64 encoded
+*/
+func (c Channel) MarshalJSON() ([]byte, error) {
+	var stored = channelJson(c.Copy())
+	if c.Options.IsBinary() {
+		stored.Data = base64.StdEncoding.EncodeToString([]byte(stored.Data))
+		for i := range(stored.Updates) {
+			stored.Updates[i].Data = base64.StdEncoding.EncodeToString([]byte(stored.Updates[i].Data))
+		}
+	}
+	return json.Marshal(stored)
+}
+
+func (c *Channel) UnmarshalJSON(data []byte) error {
+	var stored channelJson
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	if stored.Options.IsBinary() {
+		decoded, err := base64.StdEncoding.DecodeString(stored.Data)
+		if err != nil {
+			return err
+		}
+		stored.Data = string(decoded)
+		for i := range(stored.Updates) {
+			decoded, err = base64.StdEncoding.DecodeString(stored.Updates[i].Data)
+			if err != nil {
+				return err
+			}
+			stored.Updates[i].Data = string(decoded)
+		}
+	}
+	*c = Channel(stored)
+	return nil
 }
 
 func (channel *Channel) GetLastVersion() int64 {
@@ -53,34 +151,60 @@ func (channel Channel) ToJson() string {
 	return ""
 }
 
-func (channel *Channel) addNewData(command DataOperation, data string, responseListener chan ChannelDataOperation) {
+func (channel *Channel) addNewData(newData ChannelDataInputCommand, now time.Time) {
+	var command = DataOperation(newData.Command)
+	var data = newData.Data
 	var response ChannelData
 	if command == DataClear {
 		channel.DataVersion = 0
 		channel.Data = "" 
-		channel.DataTime = time.Now()
+		channel.DataTime = now
 		channel.Updates = make([]ChannelData, 0)
 		response = ChannelData{ChannelName: channel.ChannelName, DataVersion: channel.GetLastVersion(), Data: channel.Data, DataTime: channel.DataTime}
 	}	else if command == DataCreate {
 		channel.DataVersion = channel.GetLastVersion() + 1
 		channel.Data = data 
-		channel.DataTime = time.Now()
+		channel.DataTime = now
 		channel.Updates = make([]ChannelData, 0)
-		response = ChannelData{ChannelName: channel.ChannelName, DataVersion: channel.GetLastVersion(), Data: channel.Data, DataTime: channel.DataTime}
+		response = ChannelData{ChannelName: channel.ChannelName, DataVersion: channel.GetLastVersion(), Data: channel.Data, DataTime: channel.DataTime, Publisher: newData.publisher}
 	} else if command == DataUpdate {
-			var version = ChannelData{ChannelName: channel.ChannelName, DataVersion: channel.GetLastVersion() + 1, Data: data, DataTime: time.Now()}
+			var version = ChannelData{ChannelName: channel.ChannelName, DataVersion: channel.GetLastVersion() + 1, Data: data, DataTime: now, Publisher: newData.publisher}
 			channel.Updates = append(channel.Updates, version)
 			response = version
 	}
-	if (responseListener != nil) {
-		responseListener <- ChannelDataOperation{operation: command, channelData: response}
+	if (newData.responseListener != nil) {
+		newData.responseListener <- ChannelDataOperation{operation: command, channelData: response, contentType: channel.Options.ContentType, noEcho: newData.noEcho}
+	}
+}
+
+/**
+* folds updates exceeding retention into channel data - the newest folded update becomes channel data
+* subscribers in latest mode see the same data, snapshots start from the folded version
+*/
+func (channel *Channel) applyRetention(retention ChannelRetention, now time.Time) {
+	var folded = 0
+	if retention.MaxUpdates > 0 && len(channel.Updates) > retention.MaxUpdates {
+		folded = len(channel.Updates) - retention.MaxUpdates
+	}
+	if retention.MaxAge > 0 {
+		for folded < len(channel.Updates) && now.Sub(channel.Updates[folded].DataTime) > retention.MaxAge {
+			folded++
+		}
+	}
+	if folded == 0 {
+		return
 	}
+	var newest = channel.Updates[folded - 1]
+	channel.DataVersion = newest.DataVersion
+	channel.Data = newest.Data
+	channel.DataTime = newest.DataTime
+	channel.Updates = append(make([]ChannelData, 0, len(channel.Updates) - folded), channel.Updates[folded:]...)
 }
 
-func (channel *Channel) addUpdateData(data string, responseListener chan Channel) {
+func (channel *Channel) addUpdateData(data string, now time.Time, responseListener chan Channel) {
 	channel.DataVersion = channel.DataVersion + 1
 	channel.Data = data 
-	channel.DataTime = time.Now()
+	channel.DataTime = now
 	if (responseListener != nil) {
 		responseListener <- channel.Copy()
 	}
@@ -94,6 +218,11 @@ type ChannelDataInputCommand struct {
 	ChannelName string
 	DataVersion int64
 	Data string
+	// changes channel options on configure command
+	configure func(options *ChannelOptions)
+	// subscriber id of client publishing the data, empty for data from backend
+	publisher string
+	noEcho bool
 	responseListener chan ChannelDataOperation
 	
 }
@@ -0,0 +1,51 @@
+package comet
+
+import (
+	"time"
+)
+
+/**
+* source of time for the hub - tests replace it to control expiry and scheduling
+*/
+type Clock interface {
+	Now() time.Time
+	// channel receiving time after duration passes
+	After(duration time.Duration) <-chan time.Time
+	// ticker receiving time every period until stopped
+	NewTicker(period time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+/**
+* clock of the system
+*/
+type SystemClock struct {
+}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+func (SystemClock) NewTicker(period time.Duration) Ticker {
+	return systemTicker{ticker: time.NewTicker(period)}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
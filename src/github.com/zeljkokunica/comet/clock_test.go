@@ -0,0 +1,123 @@
+package comet
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+* clock moved only by the test - waiters fire when Advance passes their time
+*/
+type fakeClock struct {
+	lock sync.Mutex
+	now time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	listener chan time.Time
+	// tickers are due again every period
+	period time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(duration time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var listener = make(chan time.Time, 1)
+	if duration <= 0 {
+		listener <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeClockWaiter{at: c.now.Add(duration), listener: listener})
+	}
+	return listener
+}
+
+/**
+* waits until a process waits with After for duration from now, fails after 5 seconds
+* processes start their timers asynchronously - time must not move before they do
+*/
+func (c *fakeClock) waitForAfter(t *testing.T, duration time.Duration) {
+	var deadline = time.Now().Add(5 * time.Second)
+	for {
+		c.lock.Lock()
+		var found = false
+		for _, waiter := range(c.waiters) {
+			found = found || waiter.period == 0 && waiter.at.Sub(c.now) == duration
+		}
+		c.lock.Unlock()
+		if found {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody waits for %s", duration)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/**
+* moves time forward and fires waiters which are due
+*/
+func (c *fakeClock) Advance(duration time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(duration)
+	var waiting = c.waiters[:0]
+	for _, waiter := range(c.waiters) {
+		if !waiter.at.After(c.now) {
+			// like time.Ticker, ticks are dropped while the listener is full
+			select {
+				case waiter.listener <- c.now:
+				default:
+			}
+			if waiter.period == 0 {
+				continue
+			}
+			for !waiter.at.After(c.now) {
+				waiter.at = waiter.at.Add(waiter.period)
+			}
+		}
+		waiting = append(waiting, waiter)
+	}
+	c.waiters = waiting
+}
+
+func (c *fakeClock) NewTicker(period time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var ticker = &fakeTicker{clock: c, listener: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, fakeClockWaiter{at: c.now.Add(period), listener: ticker.listener, period: period})
+	return ticker
+}
+
+type fakeTicker struct {
+	clock *fakeClock
+	listener chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.listener
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, waiter := range(t.clock.waiters) {
+		if waiter.listener == t.listener {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i + 1:]...)
+			return
+		}
+	}
+}
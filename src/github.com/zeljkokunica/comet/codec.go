@@ -0,0 +1,144 @@
+package comet
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/**
+* wire format of responses and websocket commands
+*/
+type Codec interface {
+	/**
+	* name used in format parameter (json, msgpack, cbor)
+	*/
+	Name() string
+
+	/**
+	* http content type of encoded data
+	*/
+	ContentType() string
+
+	/**
+	* true if encoded data must be sent in binary websocket frames
+	*/
+	Binary() bool
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct {}
+
+func (c jsonCodec) Name() string { return "json" }
+func (c jsonCodec) ContentType() string { return "application/json" }
+func (c jsonCodec) Binary() bool { return false }
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+/**
+* MessagePack - field names are taken from json tags
+*/
+type msgpackCodec struct {}
+
+func (c msgpackCodec) Name() string { return "msgpack" }
+func (c msgpackCodec) ContentType() string { return "application/msgpack" }
+func (c msgpackCodec) Binary() bool { return true }
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	var encoder = msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	var decoder = msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+/**
+* CBOR - field names are taken from json tags
+*/
+type cborCodec struct {}
+
+func (c cborCodec) Name() string { return "cbor" }
+func (c cborCodec) ContentType() string { return "application/cbor" }
+func (c cborCodec) Binary() bool { return true }
+func (c cborCodec) Marshal(v interface{}) ([]byte, error) { return cbor.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+
+var JsonCodec Codec = jsonCodec{}
+var MsgpackCodec Codec = msgpackCodec{}
+var CborCodec Codec = cborCodec{}
+
+var codecs = map[string]Codec{
+	"json": JsonCodec,
+	"msgpack": MsgpackCodec,
+	"cbor": CborCodec,
+}
+
+// websocket subprotocols selecting a codec
+var codecSubprotocols = map[string]Codec{
+	"comet.json": JsonCodec,
+	"comet.msgpack": MsgpackCodec,
+	"comet.cbor": CborCodec,
+}
+
+/**
+* codec by format parameter, or by Accept header content type, json by default
+*/
+func negotiateCodec(format string, accept string) Codec {
+	if codec, found := codecs[strings.ToLower(format)]; found {
+		return codec
+	}
+	for _, mediaRange := range(strings.Split(accept, ",")) {
+		var mediaType = strings.ToLower(strings.TrimSpace(strings.Split(mediaRange, ";")[0]))
+		switch mediaType {
+			case "application/msgpack", "application/x-msgpack":
+				return MsgpackCodec
+			case "application/cbor":
+				return CborCodec
+			case "application/json":
+				return JsonCodec
+		}
+	}
+	return JsonCodec
+}
+
+/**
+* command as sent by binary codecs - data of binary channels is a byte string instead of base64 text
+*/
+type binaryCodecCommand struct {
+	Command string `json:"command"`
+	Channel string `json:"channel"`
+	Data interface{} `json:"data"`
+	DataVersion int64 `json:"version"`
+	ContentType string `json:"contentType,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	Skipped int64 `json:"skipped,omitempty"`
+}
+
+func (c SubscriberResponseCommand) binaryCodecCommand() binaryCodecCommand {
+	var result = binaryCodecCommand{c.Command, c.Channel, c.Data, c.DataVersion, c.ContentType, c.Publisher, c.CorrelationId, c.Skipped}
+	if isBinaryContentType(c.ContentType) {
+		result.Data = []byte(c.Data)
+	}
+	return result
+}
+
+func (c SubscriberResponseCommand) MarshalMsgpack() ([]byte, error) {
+	return MsgpackCodec.Marshal(c.binaryCodecCommand())
+}
+
+func (c SubscriberResponseCommand) MarshalCBOR() ([]byte, error) {
+	return CborCodec.Marshal(c.binaryCodecCommand())
+}
@@ -0,0 +1,117 @@
+package comet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	for _, check := range([]struct {
+		format string
+		accept string
+		codec Codec
+	}{
+		{"", "", JsonCodec},
+		{"msgpack", "", MsgpackCodec},
+		{"CBOR", "application/json", CborCodec},
+		{"json", "application/msgpack", JsonCodec},
+		{"xml", "", JsonCodec},
+		{"", "application/msgpack", MsgpackCodec},
+		{"", "application/x-msgpack;q=0.9", MsgpackCodec},
+		{"", "text/html, application/cbor", CborCodec},
+		{"", "application/json, application/cbor", JsonCodec},
+		{"", "text/html, */*", JsonCodec},
+	}) {
+		if codec := negotiateCodec(check.format, check.accept); codec != check.codec {
+			t.Errorf("format %q accept %q negotiated %s, expected %s", check.format, check.accept, codec.Name(), check.codec.Name())
+		}
+	}
+}
+
+/**
+* web socket subprotocol selects codec of frames in both directions, json text frames without subprotocol
+*/
+func TestWebSocketSubprotocolSelectsCodec(t *testing.T) {
+	var url = newTestWebSocketServer(t, newTestHub(t))
+	for _, check := range([]struct {
+		subprotocol string
+		codec Codec
+		messageType int
+	}{
+		{"", JsonCodec, websocket.TextMessage},
+		{"comet.json", JsonCodec, websocket.TextMessage},
+		{"comet.msgpack", MsgpackCodec, websocket.BinaryMessage},
+		{"comet.cbor", CborCodec, websocket.BinaryMessage},
+	}) {
+		var dialer = websocket.Dialer{}
+		if check.subprotocol != "" {
+			dialer.Subprotocols = []string{check.subprotocol}
+		}
+		ws, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ws.Subprotocol() != check.subprotocol {
+			t.Errorf("subprotocol %q accepted as %q", check.subprotocol, ws.Subprotocol())
+		}
+		command, _ := check.codec.Marshal(WebSocketCommand{RequestId: 1, Command: "subscribe", Parameters: map[string]interface{}{"channels": "news"}})
+		ws.WriteMessage(check.messageType, command)
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, message, err := ws.ReadMessage()
+		ws.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response struct {
+			RequestId int64 `json:"requestId"`
+			Data map[string]interface{} `json:"data"`
+		}
+		if err = check.codec.Unmarshal(message, &response); err != nil || messageType != check.messageType {
+			t.Errorf("subprotocol %q response frame type %d: %v", check.subprotocol, messageType, err)
+			continue
+		}
+		if response.RequestId != 1 || response.Data["subscriberId"] == nil {
+			t.Errorf("subprotocol %q response %v", check.subprotocol, response)
+		}
+	}
+}
+
+/**
+* binary codecs send data of binary channels as byte strings, data of other channels as text
+*/
+func TestBinaryCodecsRoundTripData(t *testing.T) {
+	var binary = string([]byte{0, 0xff, 0xfe, '\n', 'a', 0x80})
+	var response = SubscriberResponse{Status: 1, Commands: []SubscriberResponseCommand{
+		{Command: DataUpdate, Channel: "image", Data: binary, DataVersion: 3, ContentType: "image/png"},
+		{Command: DataUpdate, Channel: "news", Data: "text", DataVersion: 4},
+	}}
+	for _, codec := range([]Codec{MsgpackCodec, CborCodec}) {
+		encoded, err := codec.Marshal(response)
+		if err != nil {
+			t.Fatalf("%s: %s", codec.Name(), err.Error())
+		}
+		var decoded struct {
+			Status int `json:"status"`
+			Commands []struct {
+				Channel string `json:"channel"`
+				Data interface{} `json:"data"`
+				DataVersion int64 `json:"version"`
+				ContentType string `json:"contentType"`
+			} `json:"commands"`
+		}
+		if err = codec.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatalf("%s: %s", codec.Name(), err.Error())
+		}
+		if decoded.Status != 1 || len(decoded.Commands) != 2 {
+			t.Fatalf("%s: decoded %v", codec.Name(), decoded)
+		}
+		if data, ok := decoded.Commands[0].Data.([]byte); !ok || !bytes.Equal(data, []byte(binary)) || decoded.Commands[0].DataVersion != 3 || decoded.Commands[0].ContentType != "image/png" {
+			t.Errorf("%s: binary command decoded as %#v", codec.Name(), decoded.Commands[0])
+		}
+		if data, ok := decoded.Commands[1].Data.(string); !ok || data != "text" {
+			t.Errorf("%s: text command decoded as %#v", codec.Name(), decoded.Commands[1])
+		}
+	}
+}
@@ -4,11 +4,164 @@ import (
 	"time"
 )
 
-var expectedMaxSubscribers = 20000
-var subscriberQueueSize = 500
-var subscriberDeleteListenerQueueSize = 50
-var refreshStatusPeriod = 30 * time.Second
-var secondsToKeepSubscriberAlive int64 = 120
-var restoreData = true
-func init() {
+// requests per second and burst, per remote address, subscriber and published channel
+// off by default, so existing publishers are not limited - enabled with Hub.SetRateLimits or comet_server config
+var rateLimitPerAddress = RateLimit{}
+var rateLimitPerSubscriber = RateLimit{}
+var rateLimitPerChannel = RateLimit{}
+
+/**
+* default rate limits of a new hub
+*/
+func DefaultRateLimits() (perAddress RateLimit, perSubscriber RateLimit, perChannel RateLimit) {
+	return rateLimitPerAddress, rateLimitPerSubscriber, rateLimitPerChannel
+}
+
+// subscription filter expression and projection fields
+var maxFilterLength = 1024
+// room for web socket command fields around data of MaxDataSize
+var wsMessageOverhead int64 = 4096
+// responses smaller than this are sent uncompressed (websocket permessage-deflate and http gzip)
+var compressionThreshold = 1024
+// maximal number of requests waiting for reply
+var maxPendingRequests = 10000
+// queue item is dropped after this many deliveries
+var maxQueueDeliveries = 10
+// items waiting for a consumer per queue channel, and unacknowledged items per consumer
+var maxQueueItems = 10000
+var maxQueueItemsPerConsumer = 10
+// publishes waiting for their time
+var maxScheduledPublishes = 10000
+/**
+* clock, storage and durations of a hub - zero values are replaced by defaults
+*/
+type HubConfig struct {
+	Clock Clock
+	// channels and scheduled publishes are saved in DataDir, files served for unknown commands are read from WebRoot
+	DataDir string
+	WebRoot string
+	// saved channels and schedule are not restored on start
+	SkipRestore bool
+	// commands waiting for a subscriber before they are conflated
+	SubscriberQueueSize int
+	// buffer of hub and repository process listeners
+	ListenerQueueSize int
+	// long poll data request returns empty response after this time
+	LongPollTimeout time.Duration
+	// data waiting for a subscriber must be taken in this time, or subscriber is unsubscribed
+	FeedTimeout time.Duration
+	// subscriber without requests for this time is removed
+	SubscriberKeepAlive time.Duration
+	// status of system channel refresh and cleanup of dead subscribers
+	RefreshStatusPeriod time.Duration
+	// idle processes log they are alive
+	AliveLogPeriod time.Duration
+	// expired requests and unacknowledged queue items are checked
+	ExpiryCheckPeriod time.Duration
+	// websocket ping period, time to wait for pong (or any other message) and for a write to complete
+	WsPingPeriod time.Duration
+	WsPongWait time.Duration
+	WsWriteWait time.Duration
+	// heartbeat sent on idle server-sent events and streamed data responses
+	StreamHeartbeatPeriod time.Duration
+	// streamed data response is closed after this time, client opens a new one
+	StreamMaxDuration time.Duration
+	// request waits for reply this long, unless client asks for a different timeout up to MaxRequestTimeout
+	RequestTimeout time.Duration
+	MaxRequestTimeout time.Duration
+	// upstream of a backend route must respond within this time, unless route sets its own timeout
+	BackendTimeout time.Duration
+	// queue item is redelivered when consumer does not ack it in this time
+	QueueAckTimeout time.Duration
+	// how far ahead publishes can be scheduled
+	MaxScheduleDelay time.Duration
+	// data of channels, requests and replies larger than this is rejected
+	MaxDataSize int
+	// channels without private channels of subscribers
+	MaxChannels int
+	// including subscriber's private channel
+	MaxChannelsPerSubscriber int
+	// channel names, correlation ids and identities
+	MaxChannelNameLength int
+}
+
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		Clock: SystemClock{},
+		DataDir: "data",
+		WebRoot: "web",
+		SubscriberQueueSize: 500,
+		ListenerQueueSize: 20000,
+		LongPollTimeout: 30 * time.Second,
+		FeedTimeout: 30 * time.Second,
+		SubscriberKeepAlive: 120 * time.Second,
+		RefreshStatusPeriod: 30 * time.Second,
+		AliveLogPeriod: 30 * time.Second,
+		ExpiryCheckPeriod: time.Second,
+		WsPingPeriod: 25 * time.Second,
+		WsPongWait: 60 * time.Second,
+		WsWriteWait: 10 * time.Second,
+		StreamHeartbeatPeriod: 15 * time.Second,
+		StreamMaxDuration: 5 * time.Minute,
+		RequestTimeout: 30 * time.Second,
+		MaxRequestTimeout: 5 * time.Minute,
+		BackendTimeout: 30 * time.Second,
+		QueueAckTimeout: 30 * time.Second,
+		MaxScheduleDelay: 365 * 24 * time.Hour,
+		MaxDataSize: 64 * 1024,
+		MaxChannels: 10000,
+		MaxChannelsPerSubscriber: 100,
+		MaxChannelNameLength: 128,
+	}
+}
+
+/**
+* config with zero values replaced by defaults
+*/
+func (c HubConfig) withDefaults() HubConfig {
+	var defaults = DefaultHubConfig()
+	if c.Clock == nil {
+		c.Clock = defaults.Clock
+	}
+	if c.DataDir == "" {
+		c.DataDir = defaults.DataDir
+	}
+	if c.WebRoot == "" {
+		c.WebRoot = defaults.WebRoot
+	}
+	for _, size := range([]struct{ value *int; fallback int }{
+		{&c.SubscriberQueueSize, defaults.SubscriberQueueSize},
+		{&c.ListenerQueueSize, defaults.ListenerQueueSize},
+		{&c.MaxDataSize, defaults.MaxDataSize},
+		{&c.MaxChannels, defaults.MaxChannels},
+		{&c.MaxChannelsPerSubscriber, defaults.MaxChannelsPerSubscriber},
+		{&c.MaxChannelNameLength, defaults.MaxChannelNameLength},
+	}) {
+		if *size.value <= 0 {
+			*size.value = size.fallback
+		}
+	}
+	for _, duration := range([]struct{ value *time.Duration; fallback time.Duration }{
+		{&c.LongPollTimeout, defaults.LongPollTimeout},
+		{&c.FeedTimeout, defaults.FeedTimeout},
+		{&c.SubscriberKeepAlive, defaults.SubscriberKeepAlive},
+		{&c.RefreshStatusPeriod, defaults.RefreshStatusPeriod},
+		{&c.AliveLogPeriod, defaults.AliveLogPeriod},
+		{&c.ExpiryCheckPeriod, defaults.ExpiryCheckPeriod},
+		{&c.WsPingPeriod, defaults.WsPingPeriod},
+		{&c.WsPongWait, defaults.WsPongWait},
+		{&c.WsWriteWait, defaults.WsWriteWait},
+		{&c.StreamHeartbeatPeriod, defaults.StreamHeartbeatPeriod},
+		{&c.StreamMaxDuration, defaults.StreamMaxDuration},
+		{&c.RequestTimeout, defaults.RequestTimeout},
+		{&c.MaxRequestTimeout, defaults.MaxRequestTimeout},
+		{&c.BackendTimeout, defaults.BackendTimeout},
+		{&c.QueueAckTimeout, defaults.QueueAckTimeout},
+		{&c.MaxScheduleDelay, defaults.MaxScheduleDelay},
+	}) {
+		if *duration.value <= 0 {
+			*duration.value = duration.fallback
+		}
+	}
+	return c
 }
\ No newline at end of file
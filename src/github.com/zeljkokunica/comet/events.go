@@ -0,0 +1,129 @@
+package comet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* event id sent with every server-sent event: subscriberId;channel:version,channel:version...
+* browser sends it back as Last-Event-ID when reconnecting
+*/
+func formatEventId(subscriberId string, channelVersions map[string]int64) string {
+	var channels = make([]string, 0, len(channelVersions))
+	for channelName, version := range(channelVersions) {
+		channels = append(channels, channelName + ":" + strconv.FormatInt(version, 10))
+	}
+	sort.Strings(channels)
+	return subscriberId + ";" + strings.Join(channels, ",")
+}
+
+func parseEventId(eventId string) (string, map[string]int64) {
+	var channelVersions = make(map[string]int64)
+	var parts = strings.SplitN(eventId, ";", 2)
+	if len(parts) < 2 {
+		return strings.TrimSpace(parts[0]), channelVersions
+	}
+	for _, channelVersion := range(strings.Split(parts[1], ",")) {
+		var separator = strings.LastIndex(channelVersion, ":")
+		if separator <= 0 {
+			continue
+		}
+		version, err := strconv.ParseInt(channelVersion[separator + 1:], 10, 64)
+		if err == nil {
+			channelVersions[channelVersion[:separator]] = version
+		}
+	}
+	return parts[0], channelVersions
+}
+
+func writeEvent(m StreamDataMediator, id string, event string, data interface{}) error {
+	jsonData, _ := json.Marshal(data)
+	return m.WriteStream([]byte(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", id, event, jsonData)))
+}
+
+/**
+* server-sent events stream of subscriber data
+* parameters: id - existing subscriber, or channels - subscribe to channels, mode - subscription mode
+* Last-Event-ID (header or lastEventId parameter) continues previous subscriber if it is still alive,
+* otherwise new subscriber receives only data newer than versions in event id
+*/
+func (h *Hub) onEventsRequest(m DataMediator) {
+	stream, ok := m.(StreamDataMediator)
+	if !ok {
+		m.WriteError(http.StatusBadRequest, "events are supported only over http")
+		return
+	}
+	var lastEventId = stream.ReadHeader("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = m.ReadParameter("lastEventId")
+	}
+	var subscriberId, channelVersions = parseEventId(lastEventId)
+	if subscriberId == "" {
+		subscriberId = m.ReadParameter("id")
+	}
+	var subscriber *Subscriber
+	if existing, found := h.touchSubscriber(subscriberId); found {
+		subscriber = &existing
+	} else {
+		var channels = strings.Split(m.ReadParameter("channels"), ",")
+		if m.ReadParameter("channels") == "" {
+			for channelName := range(channelVersions) {
+				// private channel of previous subscriber can not be subscribed
+				if !strings.HasPrefix(channelName, "private_") {
+					channels = append(channels, channelName)
+				}
+			}
+		}
+		for channelName := range(channelVersions) {
+			if strings.HasPrefix(channelName, "private_") {
+				delete(channelVersions, channelName)
+			}
+		}
+		options, err := h.readSubscriptionOptions(m)
+		if err != nil {
+			writeHubError(m, err)
+			return
+		}
+		var response = h.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: channels, channelVersions: channelVersions, options: options})
+		if response.err != nil {
+			writeHubError(m, response.err)
+			return
+		}
+		subscriber = &response.subscriber
+	}
+	subscriberId = subscriber.id
+	l.If("events process - %s - start", subscriberId)
+	defer l.If("events process - %s - stop", subscriberId)
+
+	stream.StartStream("text/event-stream")
+	var heartbeat = h.config.Clock.NewTicker(h.config.StreamHeartbeatPeriod)
+	defer heartbeat.Stop()
+	var err = writeEvent(stream, formatEventId(subscriberId, channelVersions), "subscribe", map[string]interface{}{"command": "subscribe", "subscriberId": subscriberId})
+	for err == nil {
+		select {
+			case command := <- subscriber.feedListener:
+				for _, data := range(command.data) {
+					if isDataCommand(data.Command) || data.Command == DataResync {
+						channelVersions[data.Channel] = data.DataVersion
+					}
+				}
+				err = writeEvent(stream, formatEventId(subscriberId, channelVersions), "data", SubscriberResponse{Status: 1, Commands: command.data})
+			case <- heartbeat.C():
+				if _, found := h.touchSubscriber(subscriberId); !found {
+					l.Wf("events process - %s - timed out!", subscriberId)
+					writeEvent(stream, formatEventId(subscriberId, channelVersions), "data", SubscriberResponse{Status: -1})
+					return
+				}
+				err = stream.WriteStream([]byte(": heartbeat\n\n"))
+			case <- stream.Done():
+				return
+		}
+	}
+	l.If("events process - %s - error writing: %s", subscriberId, err.Error())
+}
@@ -0,0 +1,79 @@
+package comet
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+* reads server-sent events of response until event with name, returns its id and data
+*/
+func readTestEvent(t *testing.T, reader *bufio.Reader, name string) (string, string) {
+	var id, event, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event %s: %s", name, err.Error())
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				if event == name {
+					return id, data
+				}
+				event = ""
+		}
+	}
+}
+
+func openTestEvents(t *testing.T, url string, lastEventId string) (*http.Response, *bufio.Reader) {
+	request, _ := http.NewRequest("GET", url, nil)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, bufio.NewReader(response.Body)
+}
+
+/**
+* heartbeats touch subscriber while other subscribers come and go, race detector reports touches outside subscribers process
+*/
+func TestEventsHeartbeatWhileSubscribing(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.StreamHeartbeatPeriod = time.Millisecond
+	var hub = NewHub(config)
+	var server = httptest.NewServer(hub)
+	defer server.Close()
+	response, reader := openTestEvents(t, server.URL + "/events?channels=news", "")
+	defer response.Body.Close()
+	_, data := readTestEvent(t, reader, "subscribe")
+	if !strings.Contains(data, "subscriberId") {
+		t.Fatalf("subscribe event %s without subscriber", data)
+	}
+	for i := 0; i < 50; i++ {
+		var other = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}})
+		hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: other.subscriber.id})
+	}
+	hub.addNewDataToChannel(ChannelDataInputCommand{Command: DataUpdate, ChannelName: "news", Data: "first"})
+	// snapshot of subscribed channels comes first
+	var lastEventId string
+	for !strings.Contains(data, "first") {
+		lastEventId, data = readTestEvent(t, reader, "data")
+	}
+	if !strings.Contains(lastEventId, "news:1") {
+		t.Errorf("event id %s, expected news version 1", lastEventId)
+	}
+}
@@ -0,0 +1,184 @@
+package comet
+
+import (
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* data waiting for delivery to a subscriber, owned by subscriber process
+* version of the last queued data is tracked per channel - when versions are skipped
+* (data dropped by hub, conflated queue...) channel data is replaced by a fresh snapshot sent as resync
+*/
+type subscriberFeed struct {
+	subscriberId string
+	hub *Hub
+	pending []SubscriberResponseCommand
+	channels map[string]*SubscriberChannel
+}
+
+func newSubscriberFeed(subscriberId string, hub *Hub) *subscriberFeed {
+	return &subscriberFeed{
+		subscriberId: subscriberId,
+		hub: hub,
+		pending: make([]SubscriberResponseCommand, 0),
+		channels: make(map[string]*SubscriberChannel),
+	}
+}
+
+/**
+* starts tracking channel - snapshot commands bring client to channel.dataVersion
+*/
+func (f *subscriberFeed) addChannel(channel SubscriberChannel, snapshot []SubscriberResponseCommand) {
+	channel.deliveredVersion = channel.dataVersion
+	f.channels[channel.channelName] = &channel
+	f.removeChannelData(channel.channelName)
+	f.pending = append(f.pending, snapshot...)
+}
+
+/**
+* queues new channel data
+* data already queued is skipped, skipped versions cause resync of the channel
+* with noEcho data is not queued, only channel version is moved
+*/
+func (f *subscriberFeed) add(commands []SubscriberResponseCommand, noEcho bool) {
+	for _, command := range(commands) {
+		var channel = f.channels[command.Channel]
+		if channel == nil {
+			f.pending = append(f.pending, command)
+			continue
+		}
+		switch command.Command {
+			case DataResync:
+				f.resync(channel)
+			case DataClear:
+				if noEcho {
+					channel.dataVersion = command.DataVersion
+					continue
+				}
+				f.queue(channel, command)
+			case DataCreate, DataUpdate:
+				if command.DataVersion <= channel.dataVersion {
+					continue
+				}
+				if command.Command == DataUpdate && channel.dataVersion >= 0 && command.DataVersion > channel.dataVersion + 1 {
+					l.Wf("subscriber process - %s - channel %s skipped from version %d to %d", f.subscriberId, channel.channelName, channel.dataVersion, command.DataVersion)
+					f.resync(channel)
+					continue
+				}
+				if noEcho {
+					channel.dataVersion = command.DataVersion
+					continue
+				}
+				f.queue(channel, command)
+			default:
+				f.pending = append(f.pending, command)
+		}
+	}
+}
+
+/**
+* queues data for the client, versions left out since the last queued data are sent as skipped
+*/
+func (f *subscriberFeed) queue(channel *SubscriberChannel, command SubscriberResponseCommand) {
+	if channel.mode == SubscriptionLatest {
+		// replaced data was not delivered - skipped counts from data queued before it
+		for _, queued := range(f.pending) {
+			if queued.Channel == channel.channelName && isDataCommand(queued.Command) {
+				channel.deliveredVersion = queued.DataVersion - queued.Skipped - 1
+				break
+			}
+		}
+		f.removeChannelData(channel.channelName)
+	}
+	if command.Command == DataUpdate && channel.deliveredVersion >= 0 && command.DataVersion > channel.deliveredVersion + 1 {
+		command.Skipped = command.DataVersion - channel.deliveredVersion - 1
+	}
+	f.pending = append(f.pending, command)
+	channel.dataVersion = command.DataVersion
+	channel.deliveredVersion = command.DataVersion
+}
+
+/**
+* replaces queued channel data with fresh channel snapshot
+* snapshot starts with resync command carrying channel data, instead of create
+* in latest mode only the newest data is sent, in deltas mode resync carries no data
+* updates not accepted by subscription filter are left out, data is projected to subscription fields
+*/
+func (f *subscriberFeed) resync(channel *SubscriberChannel) {
+	data, err := f.hub.getChannelData(channel.channelName, -1)
+	if err != nil {
+		l.Wf("subscriber process - %s - channel %s not resynced: %s", f.subscriberId, channel.channelName, err.Error())
+		return
+	}
+	f.removeChannelData(channel.channelName)
+	var commands []SubscriberResponseCommand
+	switch channel.mode {
+		case SubscriptionDeltas:
+			commands = []SubscriberResponseCommand{SubscriberResponseCommand{Command: DataResync, Channel: channel.channelName, DataVersion: data.GetLastVersion()}}
+		default:
+			commands = channel.projection.projectCommands(subscriptionSnapshotCommands(data, -1, channel.mode, channel.filter))
+	}
+	if len(commands) > 0 {
+		commands[0].Command = DataResync
+	}
+	f.pending = append(f.pending, commands...)
+	channel.dataVersion = data.GetLastVersion()
+	channel.deliveredVersion = channel.dataVersion
+}
+
+func (f *subscriberFeed) removeChannelData(channelName string) {
+	var kept = f.pending[:0]
+	for _, command := range(f.pending) {
+		if command.Channel != channelName || !(isDataCommand(command.Command) || command.Command == DataResync) {
+			kept = append(kept, command)
+		}
+	}
+	f.pending = kept
+}
+
+/**
+* keeps about limit commands waiting for delivery
+* channels with the oldest waiting data are resynced - their data is replaced by a snapshot
+*/
+func (f *subscriberFeed) conflate(limit int) {
+	var counts = make(map[string]int)
+	for _, command := range(f.pending) {
+		if isDataCommand(command.Command) || command.Command == DataResync {
+			counts[command.Channel]++
+		}
+	}
+	var resynced = make([]*SubscriberChannel, 0)
+	var size = len(f.pending)
+	for _, command := range(f.pending) {
+		if size <= limit {
+			break
+		}
+		var channel = f.channels[command.Channel]
+		if channel == nil || counts[command.Channel] == 0 {
+			continue
+		}
+		// channel data shrinks to a single resync command
+		size -= counts[command.Channel] - 1
+		counts[command.Channel] = 0
+		resynced = append(resynced, channel)
+	}
+	for _, channel := range(resynced) {
+		f.resync(channel)
+	}
+	if len(f.pending) > limit && len(resynced) == 0 {
+		// nothing to conflate
+		l.Wf("subscriber process - %s - queue full, dropped %d commands", f.subscriberId, len(f.pending) - limit)
+		f.pending = f.pending[len(f.pending) - limit:]
+	}
+}
+
+/**
+* removes queued data after it was taken by the client
+*/
+func (f *subscriberFeed) clear() {
+	f.pending = make([]SubscriberResponseCommand, 0)
+}
+
+func isDataCommand(command string) bool {
+	return command == DataCreate || command == DataUpdate || command == DataClear
+}
@@ -0,0 +1,182 @@
+package comet
+
+import (
+	"fmt"
+	"testing"
+)
+
+/**
+* data commands of channel received by subscriber until version
+*/
+func receiveTestVersions(t *testing.T, subscriber Subscriber, channel string, version int64) []SubscriberResponseCommand {
+	var result = make([]SubscriberResponseCommand, 0)
+	for len(result) == 0 || result[len(result) - 1].DataVersion < version {
+		for _, command := range(receiveTestFeed(t, subscriber, channel)) {
+			if isDataCommand(command.Command) || command.Command == DataResync {
+				result = append(result, command)
+			}
+		}
+	}
+	return result
+}
+
+/**
+* client can tell versions left out by filter from dropped ones
+*/
+func TestFilteredUpdatesAreSkipped(t *testing.T) {
+	var hub = newTestHub(t)
+	hub.AddNewDataToChannel(DataCreate, "prices", `{"price": 1}`)
+	filter, err := parseFilter("price >= 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"prices"}, options: SubscriptionOptions{Mode: SubscriptionSnapshot, filter: filter}}).subscriber
+	for _, price := range([]int{10, 2, 3, 11}) {
+		hub.AddNewDataToChannel(DataUpdate, "prices", fmt.Sprintf(`{"price": %d}`, price))
+	}
+	var commands = receiveTestVersions(t, subscriber, "prices", 5)
+	var expected = []struct{ version int64; skipped int64 }{{1, 0}, {2, 0}, {5, 2}}
+	if len(commands) != len(expected) {
+		t.Fatalf("received %v, expected versions 1, 2 and 5", commands)
+	}
+	for i := range(expected) {
+		if commands[i].DataVersion != expected[i].version || commands[i].Skipped != expected[i].skipped {
+			t.Errorf("command %v, expected version %d with %d skipped", commands[i], expected[i].version, expected[i].skipped)
+		}
+	}
+}
+
+/**
+* publisher without echo gets next data with its own versions skipped
+*/
+func TestOwnDataIsSkipped(t *testing.T) {
+	var hub = newTestHub(t)
+	if err := hub.ConfigureChannel("chat", func(options *ChannelOptions) { options.ClientPublish = true }); err != nil {
+		t.Fatal(err)
+	}
+	var publisher = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"chat"}}).subscriber
+	hub.PublishToChannel(DataUpdate, "chat", "mine", publisher.publisherId, false)
+	hub.AddNewDataToChannel(DataUpdate, "chat", "other")
+	var commands = receiveTestVersions(t, publisher, "chat", 2)
+	var last = commands[len(commands) - 1]
+	if last.Data != "other" || last.Skipped != 1 {
+		t.Errorf("received %v, expected other with own version skipped", last)
+	}
+}
+
+/**
+* in latest mode queued data of channel is replaced by newer data, replaced versions are counted as skipped
+*/
+func TestLatestModeReplacesPendingData(t *testing.T) {
+	var feed = newSubscriberFeed("subscriber", newTestHub(t))
+	feed.addChannel(SubscriberChannel{channelName: "prices", dataVersion: 1, mode: SubscriptionLatest, droppedVersion: -1}, nil)
+	feed.addChannel(SubscriberChannel{channelName: "news", dataVersion: 1, mode: SubscriptionSnapshot, droppedVersion: -1}, nil)
+	for version := int64(2); version <= 4; version++ {
+		feed.add([]SubscriberResponseCommand{
+			{Command: DataUpdate, Channel: "prices", Data: fmt.Sprintf("price %d", version), DataVersion: version},
+			{Command: DataUpdate, Channel: "news", Data: fmt.Sprintf("news %d", version), DataVersion: version},
+		}, false)
+	}
+	var prices = make([]SubscriberResponseCommand, 0)
+	var news = 0
+	for _, command := range(feed.pending) {
+		if command.Channel == "prices" {
+			prices = append(prices, command)
+		} else {
+			news++
+		}
+	}
+	if len(prices) != 1 || prices[0].DataVersion != 4 || prices[0].Data != "price 4" || prices[0].Skipped != 2 {
+		t.Errorf("latest mode queued %v, expected only version 4 with 2 skipped", prices)
+	}
+	if news != 3 {
+		t.Errorf("snapshot mode queued %d updates, expected 3", news)
+	}
+	// delivered data is not replaced - skipped counts from it
+	feed.clear()
+	feed.add([]SubscriberResponseCommand{{Command: DataUpdate, Channel: "prices", Data: "price 5", DataVersion: 5}}, false)
+	if len(feed.pending) != 1 || feed.pending[0].Skipped != 0 {
+		t.Errorf("after delivery queued %v, expected version 5 with nothing skipped", feed.pending)
+	}
+}
+
+/**
+* latest mode subscription gets only the newest channel data, deltas mode gets no snapshot, only later data
+*/
+func TestSubscriptionModeSnapshots(t *testing.T) {
+	var hub = newTestHub(t)
+	hub.AddNewDataToChannel(DataCreate, "prices", "price 1")
+	hub.AddNewDataToChannel(DataUpdate, "prices", "price 2")
+	hub.AddNewDataToChannel(DataUpdate, "prices", "price 3")
+	var subscribe = func(mode string) Subscriber {
+		var response = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"prices"}, options: SubscriptionOptions{Mode: mode}})
+		if response.err != nil {
+			t.Fatal(response.err)
+		}
+		return response.subscriber
+	}
+	var snapshot = subscribe(SubscriptionSnapshot)
+	var latest = subscribe(SubscriptionLatest)
+	var deltas = subscribe(SubscriptionDeltas)
+	if commands := receiveTestFeed(t, snapshot, "prices"); len(commands) != 3 || commands[0].Command != DataCreate {
+		t.Errorf("snapshot mode received %v, expected create and 2 updates", commands)
+	}
+	if commands := receiveTestFeed(t, latest, "prices"); len(commands) != 1 || commands[0].Data != "price 3" {
+		t.Errorf("latest mode received %v, expected only price 3", commands)
+	}
+	hub.AddNewDataToChannel(DataUpdate, "prices", "price 4")
+	if commands := receiveTestFeed(t, deltas, "prices"); len(commands) != 1 || commands[0].Data != "price 4" {
+		t.Errorf("deltas mode received %v, expected only price 4", commands)
+	}
+}
+
+/**
+* conflation resyncs channels with the oldest queued data, resync brings channel to its newest version
+* and later skipped versions still trigger resync
+*/
+func TestConflationResyncsChannels(t *testing.T) {
+	var hub = newTestHub(t)
+	hub.AddNewDataToChannel(DataCreate, "prices", "price 1")
+	hub.AddNewDataToChannel(DataCreate, "news", "news 1")
+	var feed = newSubscriberFeed("subscriber", hub)
+	var versions = make(map[string]int64)
+	for _, channel := range([]string{"prices", "news"}) {
+		data, err := hub.getChannelData(channel, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[channel] = data.GetLastVersion()
+		feed.addChannel(SubscriberChannel{channelName: channel, dataVersion: versions[channel], mode: SubscriptionDeltas, droppedVersion: -1}, nil)
+	}
+	for _, channel := range([]string{"prices", "prices", "prices", "news"}) {
+		hub.AddNewDataToChannel(DataUpdate, channel, channel + " update")
+		versions[channel]++
+		feed.add([]SubscriberResponseCommand{{Command: DataUpdate, Channel: channel, Data: channel + " update", DataVersion: versions[channel]}}, false)
+	}
+	feed.add([]SubscriberResponseCommand{{Command: "join", Channel: "prices"}}, false)
+	feed.conflate(3)
+	var expected = []SubscriberResponseCommand{
+		{Command: DataUpdate, Channel: "news", DataVersion: versions["news"]},
+		{Command: "join", Channel: "prices"},
+		{Command: DataResync, Channel: "prices", DataVersion: versions["prices"]},
+	}
+	if len(feed.pending) != len(expected) {
+		t.Fatalf("conflated to %v, expected %v", feed.pending, expected)
+	}
+	for i := range(expected) {
+		if feed.pending[i].Command != expected[i].Command || feed.pending[i].Channel != expected[i].Channel || feed.pending[i].DataVersion != expected[i].DataVersion {
+			t.Errorf("conflated command %v, expected %v", feed.pending[i], expected[i])
+		}
+	}
+	// next version is queued, a skipped version resyncs channel again
+	feed.clear()
+	feed.add([]SubscriberResponseCommand{{Command: DataUpdate, Channel: "prices", DataVersion: versions["prices"] + 1}}, false)
+	if len(feed.pending) != 1 || feed.pending[0].Command != DataUpdate {
+		t.Errorf("after conflation queued %v, expected next update", feed.pending)
+	}
+	feed.clear()
+	feed.add([]SubscriberResponseCommand{{Command: DataUpdate, Channel: "prices", DataVersion: versions["prices"] + 3}}, false)
+	if len(feed.pending) != 1 || feed.pending[0].Command != DataResync {
+		t.Errorf("skipped version queued %v, expected resync", feed.pending)
+	}
+}
@@ -0,0 +1,293 @@
+package comet
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+/**
+* filter of channel updates requested with subscription (filter parameter)
+* conditions joined with "and", each compares a field of json data with values:
+* 	symbol = "EURUSD" and price >= 1.1 and price < 1.2 and venue in ("a", "b") and book.side != "sell"
+* values are json literals, unquoted words are strings
+* only updates are filtered, updates not matching (or not json) only move subscriber's channel version
+*/
+type dataFilter struct {
+	conditions []filterCondition
+}
+
+type filterCondition struct {
+	path []string
+	operator string
+	values []interface{}
+}
+
+/**
+* json data of channel update, parsed on first use and shared by all filters
+*/
+type filterDocument struct {
+	data string
+	parsed bool
+	value interface{}
+	valid bool
+}
+
+func (d *filterDocument) get() (interface{}, bool) {
+	if !d.parsed {
+		d.parsed = true
+		d.valid = json.Unmarshal([]byte(d.data), &d.value) == nil
+	}
+	return d.value, d.valid
+}
+
+/**
+* parses filter expression, empty expression is no filter
+*/
+func parseFilter(expression string) (*dataFilter, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+	if len(expression) > maxFilterLength {
+		return nil, newHubError(http.StatusBadRequest, "filter longer than %d characters", maxFilterLength)
+	}
+	tokens, err := filterTokens(expression)
+	if err != nil {
+		return nil, err
+	}
+	var filter = &dataFilter{conditions: make([]filterCondition, 0)}
+	var position = 0
+	next := func() string {
+		if position >= len(tokens) {
+			return ""
+		}
+		position++
+		return tokens[position - 1]
+	}
+	for {
+		var condition filterCondition
+		var field = next()
+		if field == "" || !isFilterWord(field) {
+			return nil, newHubError(http.StatusBadRequest, "filter field expected at '%s'", field)
+		}
+		condition.path = strings.Split(field, ".")
+		condition.operator = next()
+		switch condition.operator {
+			case "=", "==", "!=", "<", "<=", ">", ">=":
+				if condition.operator == "==" {
+					condition.operator = "="
+				}
+				value, err := filterValue(next())
+				if err != nil {
+					return nil, err
+				}
+				condition.values = []interface{}{value}
+			case "in":
+				if next() != "(" {
+					return nil, newHubError(http.StatusBadRequest, "filter list of %s must start with '('", field)
+				}
+				for {
+					value, err := filterValue(next())
+					if err != nil {
+						return nil, err
+					}
+					condition.values = append(condition.values, value)
+					var separator = next()
+					if separator == ")" {
+						break
+					}
+					if separator != "," {
+						return nil, newHubError(http.StatusBadRequest, "filter list of %s must end with ')'", field)
+					}
+				}
+			default:
+				return nil, newHubError(http.StatusBadRequest, "invalid filter operator '%s' for %s", condition.operator, field)
+		}
+		filter.conditions = append(filter.conditions, condition)
+		var joiner = next()
+		if joiner == "" {
+			break
+		}
+		if joiner != "and" && joiner != "&&" {
+			return nil, newHubError(http.StatusBadRequest, "filter conditions must be joined with 'and', found '%s'", joiner)
+		}
+	}
+	return filter, nil
+}
+
+/**
+* splits expression into words, json strings, operators and list punctuation
+*/
+func filterTokens(expression string) ([]string, error) {
+	var tokens = make([]string, 0)
+	var runes = []rune(expression)
+	for i := 0; i < len(runes); {
+		var r = runes[i]
+		switch {
+			case unicode.IsSpace(r):
+				i++
+			case r == '(' || r == ')' || r == ',':
+				tokens = append(tokens, string(r))
+				i++
+			case r == '"':
+				var end = i + 1
+				for end < len(runes) && runes[end] != '"' {
+					if runes[end] == '\\' {
+						end++
+					}
+					end++
+				}
+				if end >= len(runes) {
+					return nil, newHubError(http.StatusBadRequest, "unterminated string in filter")
+				}
+				tokens = append(tokens, string(runes[i:end + 1]))
+				i = end + 1
+			case strings.ContainsRune("=!<>&", r):
+				var end = i + 1
+				for end < len(runes) && strings.ContainsRune("=!<>&", runes[end]) {
+					end++
+				}
+				tokens = append(tokens, string(runes[i:end]))
+				i = end
+			default:
+				var end = i
+				for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()=!<>&,\"", runes[end]) {
+					end++
+				}
+				tokens = append(tokens, string(runes[i:end]))
+				i = end
+		}
+	}
+	return tokens, nil
+}
+
+func isFilterWord(token string) bool {
+	return token != "" && !strings.ContainsAny(token, "()=!<>&,\"")
+}
+
+/**
+* json literal, or unquoted word as string
+*/
+func filterValue(token string) (interface{}, error) {
+	if token == "" || token == "(" || token == ")" || token == "," {
+		return nil, newHubError(http.StatusBadRequest, "filter value expected at '%s'", token)
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(token), &value); err == nil {
+		return value, nil
+	}
+	if strings.HasPrefix(token, "\"") || !isFilterWord(token) {
+		return nil, newHubError(http.StatusBadRequest, "invalid filter value %s", token)
+	}
+	return token, nil
+}
+
+/**
+* true if document matches all conditions
+*/
+func (f *dataFilter) matches(document *filterDocument) bool {
+	value, valid := document.get()
+	if !valid {
+		return false
+	}
+	for _, condition := range(f.conditions) {
+		if !condition.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+* true if command is delivered - only updates are filtered
+*/
+func (f *dataFilter) accepts(command string, document *filterDocument) bool {
+	return f == nil || command != DataUpdate || f.matches(document)
+}
+
+func (c filterCondition) matches(document interface{}) bool {
+	var value = document
+	for _, field := range(c.path) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return c.operator == "!="
+		}
+		if value, ok = object[field]; !ok {
+			return c.operator == "!="
+		}
+	}
+	switch c.operator {
+		case "=":
+			return compareFilterValues(value, c.values[0]) == 0
+		case "!=":
+			return compareFilterValues(value, c.values[0]) != 0
+		case "<":
+			var result = compareFilterValues(value, c.values[0])
+			return result != filterIncomparable && result < 0
+		case "<=":
+			var result = compareFilterValues(value, c.values[0])
+			return result != filterIncomparable && result <= 0
+		case ">":
+			var result = compareFilterValues(value, c.values[0])
+			return result != filterIncomparable && result > 0
+		case ">=":
+			var result = compareFilterValues(value, c.values[0])
+			return result != filterIncomparable && result >= 0
+		case "in":
+			for _, candidate := range(c.values) {
+				if compareFilterValues(value, candidate) == 0 {
+					return true
+				}
+			}
+	}
+	return false
+}
+
+const filterIncomparable = 2
+
+/**
+* -1, 0 or 1 for numbers and strings, 0 for equal booleans and nulls, filterIncomparable otherwise
+*/
+func compareFilterValues(a interface{}, b interface{}) int {
+	switch x := a.(type) {
+		case float64:
+			if y, ok := b.(float64); ok {
+				if x < y {
+					return -1
+				} else if x > y {
+					return 1
+				}
+				return 0
+			}
+		case string:
+			if y, ok := b.(string); ok {
+				return strings.Compare(x, y)
+			}
+		case bool:
+			if y, ok := b.(bool); ok && x == y {
+				return 0
+			}
+		case nil:
+			if b == nil {
+				return 0
+			}
+	}
+	return filterIncomparable
+}
+
+/**
+* removes updates not accepted by filter from snapshot commands
+*/
+func (f *dataFilter) filterCommands(commands []SubscriberResponseCommand) []SubscriberResponseCommand {
+	if f == nil {
+		return commands
+	}
+	var result = make([]SubscriberResponseCommand, 0, len(commands))
+	for _, command := range(commands) {
+		if f.accepts(command.Command, &filterDocument{data: command.Data}) {
+			result = append(result, command)
+		}
+	}
+	return result
+}
@@ -1,12 +1,13 @@
 package comet
 
 import (
+	"net/http"
 	"strings"
-	"time"
 	"github.com/zeljkokunica/l"
 	"fmt"
 	"io"
 	"crypto/rand"
+	"sort"
 )
 
 const (
@@ -15,13 +16,35 @@ const (
 	SubscribeToChannels = 3
 	UnsubscribeFromChannels = 4
 	CleanupSubscribers = 5
+	ResyncChannels = 6
+	GetPresence = 7
+	TouchSubscriber = 8
+	GetSubscribersStatus = 9
+	ConfigurePresence = 10
+	SubscribedToChannel = 11
 )
 
 type HubSubscriberRequest struct {
 	command int
 	subscriberId string
 	channels []string
-	responseListener chan<- Subscriber
+	// last data version client already has for a channel - only newer data is sent
+	channelVersions map[string]int64
+	options SubscriptionOptions
+	// presence of channel for ConfigurePresence
+	presence bool
+	responseListener chan<- HubSubscriberResponse
+}
+
+type HubSubscriberResponse struct {
+	subscriber Subscriber
+	err error
+	// members of channel for GetPresence
+	members []PresenceMember
+	// subscribers for GetSubscribersStatus
+	status []HubStatusSubscriber
+	// subscriber is on channel for SubscribedToChannel
+	subscribed bool
 }
 
 type Hub struct {
@@ -29,16 +52,48 @@ type Hub struct {
 	repository *HubRepository
 	subscriberFeedListener chan ChannelDataOperation
 	subscriberCommandListener chan HubSubscriberRequest
+	addressLimiter *RateLimiter
+	subscriberLimiter *RateLimiter
+	channelLimiter *RateLimiter
+	// channel name -> subscriber id -> member, for channels with presence enabled
+	presence map[string]map[string]PresenceMember
+	requestListener chan requestProcessCommand
+	backendRoutes *backendRoutes
+	queueListener chan queueProcessCommand
+	scheduleListener chan scheduleProcessCommand
+	config HubConfig
+	access *hubAccess
+	reloader *hubReloader
 }
 
-func NewHub() *Hub {
+/**
+* starts hub processes - zero values of config are replaced by DefaultHubConfig
+*/
+func NewHub(config HubConfig) *Hub {
 	var hub = new(Hub)
+	hub.config = config.withDefaults()
+	hub.access = newHubAccess()
+	hub.reloader = new(hubReloader)
 	hub.subscribers = make(map[string]*Subscriber)
-	hub.repository = NewHubRepository()
-	hub.subscriberCommandListener = make(chan HubSubscriberRequest, expectedMaxSubscribers)
-	hub.subscriberFeedListener = make(chan ChannelDataOperation, expectedMaxSubscribers)
+	hub.presence = make(map[string]map[string]PresenceMember)
+	hub.repository = NewHubRepository(hub.config)
+	hub.subscriberCommandListener = make(chan HubSubscriberRequest, hub.config.ListenerQueueSize)
+	hub.subscriberFeedListener = make(chan ChannelDataOperation, hub.config.ListenerQueueSize)
+	hub.addressLimiter = NewRateLimiter(rateLimitPerAddress)
+	hub.subscriberLimiter = NewRateLimiter(rateLimitPerSubscriber)
+	hub.channelLimiter = NewRateLimiter(rateLimitPerChannel)
+	for _, limiter := range([]*RateLimiter{hub.addressLimiter, hub.subscriberLimiter, hub.channelLimiter}) {
+		limiter.clock = hub.config.Clock
+	}
+	hub.requestListener = make(chan requestProcessCommand)
+	hub.backendRoutes = newBackendRoutes()
+	hub.queueListener = make(chan queueProcessCommand, hub.config.ListenerQueueSize)
+	hub.scheduleListener = make(chan scheduleProcessCommand)
 	go hub.subscribersProcess()
 	go hub.refreshStatusProcess()
+	go hub.requestsProcess()
+	go hub.queuesProcess()
+	go hub.scheduleProcess()
 	return hub
 }
 
@@ -47,61 +102,206 @@ func NewHub() *Hub {
 */
 func (h *Hub) subscribersProcess() {
 	l.I("subscribers process - starting") 
+	var aliveTicker = h.config.Clock.NewTicker(h.config.AliveLogPeriod)
+	defer aliveTicker.Stop()
 	for {
 		select {
 			case newData := <- h.subscriberFeedListener:
-				l.If("subscribers process - newData", newData)
+				l.If("subscribers process - newData %s", newData.channelData.ChannelName)
+				var document = filterDocument{data: newData.channelData.Data}
+				// projected data by projection key
+				var projected = make(map[string]string)
 				for _, subscriber := range(h.subscribers) {
-					if subscriber.channels[newData.channelData.ChannelName] != nil {
-						select {
-							case subscriber.commandListener <- SubscriberControlCommand{SubscriberFeed, CreateSingleFeedCommad(string(newData.operation), newData.channelData.ChannelName, newData.channelData.Data, newData.channelData.DataVersion)}:
-							default:
-								l.Wf("subscribers process - did not deliver new data to %s - queue full", subscriber.id) 
+					if newData.subscriberId != "" && subscriber.id != newData.subscriberId {
+						continue
+					}
+					if channel := subscriber.channels[newData.channelData.ChannelName]; channel != nil {
+						var echo = !newData.noEcho || subscriber.publisherId != newData.channelData.Publisher
+						// filtered out data only moves subscriber's channel version, like data without echo
+						echo = echo && channel.filter.accepts(string(newData.operation), &document)
+						var data = newData.channelData.Data
+						if channel.projection != nil && echo && (newData.operation == DataCreate || newData.operation == DataUpdate) {
+							var found bool
+							if data, found = projected[channel.projection.key]; !found {
+								data = channel.projection.project(newData.channelData.Data)
+								projected[channel.projection.key] = data
+							}
 						}
+						h.feedSubscriber(subscriber, channel, SubscriberResponseCommand{Command: string(newData.operation), Channel: newData.channelData.ChannelName, Data: data, DataVersion: newData.channelData.DataVersion, ContentType: newData.contentType, Publisher: newData.channelData.Publisher, CorrelationId: newData.correlationId}, echo)
 					}
 				}
 			case subscriberCommand := <- h.subscriberCommandListener:
 				switch subscriberCommand.command {
 					case Subscribe: 
 						l.I("subscribers process - subscribe")
-						newSubscriber := h.createSubscriber(subscriberCommand.channels)
-						subscriberCommand.responseListener <- newSubscriber
+						newSubscriber, err := h.createSubscriber(subscriberCommand.channels, subscriberCommand.options, subscriberCommand.channelVersions)
+						subscriberCommand.responseListener <- HubSubscriberResponse{subscriber: newSubscriber, err: err}
 					case Unsubscribe: 
 						l.If("subscribers process - %s - unsubscribe", subscriberCommand.subscriberId)
 						h.deleteSubscriber(subscriberCommand.subscriberId)
-						subscriberCommand.responseListener <- Subscriber{}		
+						if subscriberCommand.responseListener != nil {
+							subscriberCommand.responseListener <- HubSubscriberResponse{}
+						}
 					case SubscribeToChannels:
-						l.If("subscribers process - %s - subscribe to channels", subscriberCommand.subscriberId, subscriberCommand.channels)
+						l.If("subscribers process - %s - subscribe to channels %s", subscriberCommand.subscriberId, subscriberCommand.channels)
 						if subscriber, found := h.subscribers[subscriberCommand.subscriberId]; found == true {
-							h.addChannelsToSubscriber(subscriberCommand.channels, subscriber)
-							subscriberCommand.responseListener <- *subscriber
+							err := h.addChannelsToSubscriber(subscriberCommand.channels, subscriber, subscriberCommand.options, subscriberCommand.channelVersions)
+							subscriberCommand.responseListener <- HubSubscriberResponse{subscriber: *subscriber, err: err}
 						} else {
-							subscriberCommand.responseListener <- Subscriber{}
+							subscriberCommand.responseListener <- HubSubscriberResponse{}
 						}
 					case UnsubscribeFromChannels:
-						l.If("subscribers process - %s - unsubscribe from channels", subscriberCommand.subscriberId, subscriberCommand.channels)
+						l.If("subscribers process - %s - unsubscribe from channels %s", subscriberCommand.subscriberId, subscriberCommand.channels)
 						if subscriber, found := h.subscribers[subscriberCommand.subscriberId]; found == true {
 							h.removeChannelsFromSubscriber(subscriberCommand.channels, subscriber)
-							subscriberCommand.responseListener <- *subscriber
+							subscriberCommand.responseListener <- HubSubscriberResponse{subscriber: *subscriber}
 						} else {
-							subscriberCommand.responseListener <- Subscriber{}
+							subscriberCommand.responseListener <- HubSubscriberResponse{}
+						}
+					case ResyncChannels:
+						l.If("subscribers process - %s - resync channels %s", subscriberCommand.subscriberId, subscriberCommand.channels)
+						if subscriber, found := h.subscribers[subscriberCommand.subscriberId]; found == true {
+							for _, channelName := range(subscriberCommand.channels) {
+								if _, found := subscriber.channels[channelName]; found {
+									subscriber.send(SubscriberControlCommand{command: SubscriberFeed, SubscriberFeedCommand: CreateSingleFeedCommad(DataResync, channelName, "", -1, "")})
+								}
+							}
+							subscriberCommand.responseListener <- HubSubscriberResponse{subscriber: *subscriber}
+						} else {
+							subscriberCommand.responseListener <- HubSubscriberResponse{}
+						}
+					case GetPresence:
+						subscriberCommand.responseListener <- HubSubscriberResponse{members: h.presenceMembers(subscriberCommand.channels[0])}
+					case ConfigurePresence:
+						h.configurePresence(subscriberCommand.channels[0], subscriberCommand.presence)
+						subscriberCommand.responseListener <- HubSubscriberResponse{}
+					case SubscribedToChannel:
+						var response HubSubscriberResponse
+						if subscriber, found := h.subscribers[subscriberCommand.subscriberId]; found {
+							_, response.subscribed = subscriber.channels[subscriberCommand.channels[0]]
+						}
+						subscriberCommand.responseListener <- response
+					case TouchSubscriber:
+						var response HubSubscriberResponse
+						if subscriber, found := h.subscribers[subscriberCommand.subscriberId]; found {
+							subscriber.lastRequest = h.config.Clock.Now()
+							response.subscriber = *subscriber
 						}
+						subscriberCommand.responseListener <- response
+					case GetSubscribersStatus:
+						var status = make([]HubStatusSubscriber, 0, len(h.subscribers))
+						for _, subscriber := range(h.subscribers) {
+							var channels = make([]string, 0, len(subscriber.channels))
+							for channelName := range(subscriber.channels) {
+								if !strings.HasPrefix(channelName, "private_") {
+									channels = append(channels, channelName)
+								}
+							}
+							sort.Strings(channels)
+							status = append(status, HubStatusSubscriber{Identity: subscriber.identity, Channels: channels})
+						}
+						subscriberCommand.responseListener <- HubSubscriberResponse{status: status}
 					case CleanupSubscribers: 
-						var cleanupStartTime = time.Now().Unix()
+						var cleanupStartTime = h.config.Clock.Now()
 						for id, subscriber := range(h.subscribers) {
-							if cleanupStartTime - subscriber.lastRequest > secondsToKeepSubscriberAlive {
+							if cleanupStartTime.Sub(subscriber.lastRequest) > h.config.SubscriberKeepAlive {
 								l.If("subscribers process - found dead subscriber %s", id)
 								h.deleteSubscriber(id)
+								continue
+							}
+							// retry resync of channels whose data was dropped
+							for _, channel := range(subscriber.channels) {
+								if channel.droppedVersion >= 0 {
+									h.feedSubscriber(subscriber, channel, SubscriberResponseCommand{Command: DataResync, Channel: channel.channelName, DataVersion: channel.droppedVersion}, true)
+								}
 							}
 						}
+						h.reclaimChannels()
 				}
-			case <- time.After(30 * time.Second):
-    		l.If("subscribers process - alive")
+			case <- aliveTicker.C():
+				l.If("subscribers process - alive")
 		}
 	}
 	l.I("subscribers process - stopped")
 }
 
+/**
+* passes channel data to subscriber process without waiting
+* if subscriber can not take it, data is dropped and subscriber gets resync command for the channel later
+* data without echo only moves subscriber's channel version
+*/
+func (h *Hub) feedSubscriber(subscriber *Subscriber, channel *SubscriberChannel, command SubscriberResponseCommand, echo bool) {
+	if channel.droppedVersion >= 0 && isDataCommand(command.Command) {
+		if channel.droppedVersion > command.DataVersion {
+			command.DataVersion = channel.droppedVersion
+		}
+		command = SubscriberResponseCommand{Command: DataResync, Channel: channel.channelName, DataVersion: command.DataVersion}
+	}
+	var controlCommand = SubscriberControlCommand{
+		command: SubscriberFeed,
+		SubscriberFeedCommand: SubscriberFeedCommand{data: []SubscriberResponseCommand{command}},
+		noEcho: !echo,
+	}
+	select {
+		case subscriber.commandListener <- controlCommand:
+			channel.droppedVersion = -1
+		default:
+			if isDataCommand(command.Command) || command.Command == DataResync {
+				channel.droppedVersion = command.DataVersion
+			}
+			l.Wf("subscribers process - did not deliver new data to %s - queue full", subscriber.id)
+	}
+}
+
+/**
+* sends request to subscribers process and waits for its response
+*/
+func (h *Hub) requestSubscriber(request HubSubscriberRequest) HubSubscriberResponse {
+	var responseListener = make(chan HubSubscriberResponse)
+	defer close(responseListener)
+	request.responseListener = responseListener
+	h.subscriberCommandListener <- request
+	return <- responseListener
+}
+
+/**
+* changes rate limits of running hub
+*/
+func (h *Hub) SetRateLimits(perAddress RateLimit, perSubscriber RateLimit, perChannel RateLimit) {
+	h.addressLimiter.SetLimit(perAddress)
+	h.subscriberLimiter.SetLimit(perSubscriber)
+	h.channelLimiter.SetLimit(perChannel)
+}
+
+/**
+* replaces update retention of channels, channels apply it on their next update
+*/
+func (h *Hub) SetRetention(retention ChannelRetention) {
+	h.repository.setRetention(retention)
+}
+
+/**
+* refreshes subscriber last request time, returns false if subscriber does not exist anymore
+* subscribers are owned by subscribers process, so it is asked to do it
+*/
+func (h *Hub) touchSubscriber(id string) (Subscriber, bool) {
+	if id == "" {
+		return Subscriber{}, false
+	}
+	var response = h.requestSubscriber(HubSubscriberRequest{command: TouchSubscriber, subscriberId: id})
+	return response.subscriber, response.subscriber.id != ""
+}
+
+/**
+* true if subscriber is subscribed to channel
+*/
+func (h *Hub) subscribedToChannel(id string, channel string) bool {
+	if id == "" {
+		return false
+	}
+	return h.requestSubscriber(HubSubscriberRequest{command: SubscribedToChannel, subscriberId: id, channels: []string{channel}}).subscribed
+}
+
 func newUUID() (string, error) {
 	uuid := make([]byte, 16)
 	n, err := io.ReadFull(rand.Reader, uuid)
@@ -115,55 +315,197 @@ func newUUID() (string, error) {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
 }
 
-func (h *Hub) createSubscriber(channels []string) Subscriber{
+func (h *Hub) createSubscriber(channels []string, options SubscriptionOptions, channelVersions map[string]int64) (Subscriber, error) {
 	l.If("subscriber creating with channels %s", channels)
 	var id, err = newUUID()
 	if err != nil {
 		l.Ef("Error creation new uuid %s", err.Error())
 	}
+	publisherId, err := newUUID()
+	if err != nil {
+		l.Ef("Error creation new uuid %s", err.Error())
+	}
 	
 	subscriber := Subscriber{
 		id: id, 
+		publisherId: publisherId,
 		commandListener:  make(chan SubscriberControlCommand, 10), 
-		feedListener: make(chan SubscriberFeedCommand, subscriberQueueSize),
+		// unbuffered - data waits in subscriber process until client takes it
+		feedListener: make(chan SubscriberFeedCommand),
+		stop: make(chan bool),
+		stopped: make(chan bool),
 		channels: make(map[string]*SubscriberChannel),
+		identity: options.Identity,
+		metadata: options.Metadata,
+	}
+	var privateChannel = privateChannelName(id)
+	if err = h.validateSubscriberChannels(append(channels, privateChannel), &subscriber); err != nil {
+		l.Wf("subscriber not created: %s", err.Error())
+		return Subscriber{}, err
 	}
-	channels = append(channels, fmt.Sprintf("private_%s", id))
-	h.addChannelsToSubscriber(channels, &subscriber)
-	subscriber.lastRequest = time.Now().Unix()
+	subscriber.lastRequest = h.config.Clock.Now()
 	go subscriber.subscriberCommandProcess(h)
+	// subscriber receives presence events of channels it joins
 	h.subscribers[id] = &subscriber
+	// without private channel subscriber could not receive replies and errors
+	if err = h.addChannelsToSubscriber([]string{privateChannel}, &subscriber, SubscriptionOptions{}, nil); err != nil {
+		l.Ef("subscriber %s not created, private channel failed: %s", id, err.Error())
+		h.deleteSubscriber(id)
+		return Subscriber{}, err
+	}
+	// client gets the error, subscriber without some of its channels is not kept
+	if err = h.addChannelsToSubscriber(channels, &subscriber, options, channelVersions); err != nil {
+		l.Wf("subscriber %s not created: %s", id, err.Error())
+		h.deleteSubscriber(id)
+		return Subscriber{}, err
+	}
 	l.If("subscriber %s created with channels %s", id, channels)
-	return subscriber
+	return subscriber, nil
+}
+
+/**
+* checks channel names and number of channels subscriber would have after adding channels
+* private channels of other subscribers can not be subscribed
+*/
+func (h *Hub) validateSubscriberChannels(channels []string, s *Subscriber) error {
+	var channelCount = len(s.channels)
+	for _, channelName := range(channels) {
+		if len(strings.Trim(channelName, "")) == 0 {
+			continue
+		}
+		if err := h.validateChannelName(channelName); err != nil {
+			return err
+		}
+		if strings.HasPrefix(channelName, "private_") && channelName != privateChannelName(s.id) {
+			return newHubError(http.StatusForbidden, "subscribing to private channels is not allowed")
+		}
+		if _, found := s.channels[channelName]; !found {
+			channelCount++
+		}
+	}
+	if channelCount > h.config.MaxChannelsPerSubscriber {
+		return newHubError(http.StatusForbidden, "subscriber can have at most %d channels", h.config.MaxChannelsPerSubscriber)
+	}
+	return nil
 }
 
-func (h *Hub) addChannelsToSubscriber(channels []string, s *Subscriber) {
+func (h *Hub) addChannelsToSubscriber(channels []string, s *Subscriber, options SubscriptionOptions, channelVersions map[string]int64) error {
+	if err := h.validateSubscriberChannels(channels, s); err != nil {
+		return err
+	}
+	if options.Identity != "" || options.Metadata != "" {
+		s.identity = options.Identity
+		s.metadata = options.Metadata
+	}
+	var result error
 	for i := range(channels) {
 		var channelName = channels[i]
 		if len(strings.Trim(channelName, "")) == 0 {
 			continue
 		}
 		
+		var lastDataVersion int64 = -1
+		if version, found := channelVersions[channelName]; found {
+			lastDataVersion = version
+		}
+		data, err := h.getChannelData(channelName, lastDataVersion)
+		if err != nil {
+			l.Wf("channel %s not added to %s: %s", channelName, s.id, err.Error())
+			result = err
+			continue
+		}
 		var channel = new (SubscriberChannel)
 		channel.channelName = channelName
-		channel.dataVersion = -1
+		channel.dataVersion = data.GetLastVersion()
+		channel.mode = options.Mode
+		channel.droppedVersion = -1
+		channel.filter = options.filter
+		channel.projection = options.projection
 		s.channels[channelName] = channel
-		var responseReceiver = make(chan Channel)
-		channelFeedsListener := make(chan HubRepositoryChannelFeeds)
-		defer close(channelFeedsListener)
-		h.repository.getChannelListener <- HubRepositoryChannelGetCommand{channelName: channelName, resultListener: channelFeedsListener}
-		var channelFeeds = <- channelFeedsListener
-		channelFeeds.getDataListener <- ChannelDataRequestCommand{channelName: channelName, lastDataVersion: -1, responseReceiver: responseReceiver}
-		var data = <-responseReceiver
-		var commands = make([]SubscriberResponseCommand,  len(data.Updates) + 1)
-		commands[0] = SubscriberResponseCommand{DataCreate, data.ChannelName, data.Data, data.DataVersion}
-		for i := 0; i < len(data.Updates); i++ {
-			commands[ i + 1] = SubscriberResponseCommand{DataUpdate, data.Updates[i].ChannelName, data.Updates[i].Data, data.Updates[i].DataVersion}
-		}
-		s.feedListener <- SubscriberFeedCommand{data: commands}
-		
-		close(responseReceiver)
+		var commands []SubscriberResponseCommand
+		if options.Mode != SubscriptionDeltas {
+			commands = options.projection.projectCommands(subscriptionSnapshotCommands(data, lastDataVersion, options.Mode, options.filter))
+		}
+		s.send(SubscriberControlCommand{command: SubscriberAddChannel, SubscriberFeedCommand: SubscriberFeedCommand{data: commands}, channel: *channel})
+		if data.Options.Presence {
+			channel.presence = true
+			h.joinPresence(channelName, s)
+		}
+		if data.Options.Queue != "" {
+			channel.queue = true
+			h.queueListener <- queueProcessCommand{command: queueConsumerJoin, channelName: channelName, dispatch: data.Options.Queue, subscriberId: s.id}
+		}
+	}
+	return result
+}
+
+/**
+* current channel data, with updates newer than lastDataVersion
+*/
+func (h *Hub) getChannelData(channelName string, lastDataVersion int64) (Channel, error) {
+	var responseReceiver = make(chan Channel)
+	defer close(responseReceiver)
+	for {
+		var channelFeeds = h.channelFeeds(channelName)
+		if channelFeeds.err != nil {
+			return Channel{}, channelFeeds.err
+		}
+		select {
+			case channelFeeds.getDataListener <- ChannelDataRequestCommand{channelName: channelName, lastDataVersion: lastDataVersion, responseReceiver: responseReceiver}:
+				return <- responseReceiver, nil
+			case <- channelFeeds.stopped:
+		}
+	}
+}
+
+/**
+* commands bringing client from lastDataVersion to current channel state
+* only missing updates are sent when client's version is still in channel's updates, otherwise complete channel
+*/
+func channelSnapshotCommands(data Channel, lastDataVersion int64) []SubscriberResponseCommand {
+	var commands = make([]SubscriberResponseCommand, 0, len(data.Updates) + 1)
+	if lastDataVersion < data.DataVersion || lastDataVersion > data.GetLastVersion() {
+		commands = append(commands, SubscriberResponseCommand{Command: DataCreate, Channel: data.ChannelName, Data: data.Data, DataVersion: data.DataVersion, ContentType: data.Options.ContentType})
+	}
+	for i := 0; i < len(data.Updates); i++ {
+		if len(commands) == 0 && data.Updates[i].DataVersion <= lastDataVersion {
+			continue
+		}
+		commands = append(commands, SubscriberResponseCommand{Command: DataUpdate, Channel: data.Updates[i].ChannelName, Data: data.Updates[i].Data, DataVersion: data.Updates[i].DataVersion, ContentType: data.Options.ContentType, Publisher: data.Updates[i].Publisher})
+	}
+	return commands
+}
+
+/**
+* commands bringing subscriber to current channel state in snapshot or latest mode
+* updates not accepted by filter are left out, in latest mode the newest accepted data is sent
+*/
+func subscriptionSnapshotCommands(data Channel, lastDataVersion int64, mode string, filter *dataFilter) []SubscriberResponseCommand {
+	if mode != SubscriptionLatest {
+		return filter.filterCommands(channelSnapshotCommands(data, lastDataVersion))
+	}
+	if filter == nil {
+		return channelLatestCommands(data, lastDataVersion)
+	}
+	var commands = filter.filterCommands(channelSnapshotCommands(data, lastDataVersion))
+	if len(commands) == 0 {
+		return commands
 	}
+	return commands[len(commands) - 1:]
+}
+
+/**
+* only the newest data of a channel - last update, or channel data when there are no updates
+*/
+func channelLatestCommands(data Channel, lastDataVersion int64) []SubscriberResponseCommand {
+	if data.GetLastVersion() <= lastDataVersion && lastDataVersion >= data.DataVersion {
+		return nil
+	}
+	if len(data.Updates) > 0 {
+		var update = data.Updates[len(data.Updates) - 1]
+		return []SubscriberResponseCommand{SubscriberResponseCommand{Command: DataUpdate, Channel: update.ChannelName, Data: update.Data, DataVersion: update.DataVersion, ContentType: data.Options.ContentType, Publisher: update.Publisher}}
+	}
+	return []SubscriberResponseCommand{SubscriberResponseCommand{Command: DataCreate, Channel: data.ChannelName, Data: data.Data, DataVersion: data.DataVersion, ContentType: data.Options.ContentType}}
 }
 
 func (h *Hub) removeChannelsFromSubscriber(channels []string, s *Subscriber) {
@@ -172,16 +514,48 @@ func (h *Hub) removeChannelsFromSubscriber(channels []string, s *Subscriber) {
 		if len(strings.Trim(channelName, "")) == 0 {
 			continue
 		}
-		if _, found := s.channels[channelName]; found == true {
+		if channel, found := s.channels[channelName]; found == true {
 			delete(s.channels, channelName)
+			if channel.presence {
+				h.leavePresence(channelName, s)
+			}
+			if channel.queue {
+				h.queueListener <- queueProcessCommand{command: queueConsumerLeave, channelName: channelName, subscriberId: s.id}
+			}
+		}
+	}
+}
+
+/**
+* asks repository to remove empty channels nobody is subscribed to, skipped while previous request is waiting
+*/
+func (h *Hub) reclaimChannels() {
+	var subscribed = make(map[string]bool)
+	for _, subscriber := range(h.subscribers) {
+		for channelName := range(subscriber.channels) {
+			subscribed[channelName] = true
 		}
 	}
+	select {
+		case h.repository.reclaimListener <- subscribed:
+		default:
+	}
 }
 
 func (h *Hub) deleteSubscriber(id string) {
 	if subscriber, found := h.subscribers[id]; found == true {
-		subscriber.commandListener <- SubscriberControlCommand{command: SubscriberStop}
+		// subscriber process may already be stopped (feed timeout) - it is not waited for
+		close(subscriber.stop)
 		delete(h.subscribers, id)
+		for channelName, channel := range(subscriber.channels) {
+			if channel.presence {
+				h.leavePresence(channelName, subscriber)
+			}
+			if channel.queue {
+				h.queueListener <- queueProcessCommand{command: queueConsumerLeave, channelName: channelName, subscriberId: id}
+			}
+		}
+		h.repository.removeChannelListener <- privateChannelName(id)
 		l.Df("subscriber deleted %s", id)
 	}
 }
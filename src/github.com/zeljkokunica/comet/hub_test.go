@@ -0,0 +1,212 @@
+package comet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* hubs keep running after their test (status process stores system channel), data of all tests is removed at the end
+*/
+var testDataDir string
+
+func TestMain(m *testing.M) {
+	// hub processes log every command
+	l.SetMinLogLevel(3)
+	var err error
+	if testDataDir, err = ioutil.TempDir("", "comet"); err != nil {
+		panic(err)
+	}
+	var result = m.Run()
+	os.RemoveAll(testDataDir)
+	os.Exit(result)
+}
+
+/**
+* config of hub storing data in its own directory
+*/
+func newTestHubConfig(t *testing.T) HubConfig {
+	dataDir, err := ioutil.TempDir(testDataDir, "hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return HubConfig{DataDir: dataDir, SkipRestore: true}
+}
+
+func newTestHub(t *testing.T) *Hub {
+	return NewHub(newTestHubConfig(t))
+}
+
+/**
+* touches run beside subscribe and unsubscribe, race detector reports touches outside subscribers process
+*/
+func TestTouchSubscriberWhileSubscribing(t *testing.T) {
+	var hub = newTestHub(t)
+	var response = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"touched"}})
+	if response.err != nil {
+		t.Fatal(response.err)
+	}
+	var id = response.subscriber.id
+	var done = make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if _, found := hub.touchSubscriber(id); !found {
+				t.Errorf("touch %d did not find subscriber", i)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		var other = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"touched"}})
+		hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: other.subscriber.id})
+	}
+	<- done
+	hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: id})
+	if _, found := hub.touchSubscriber(id); found {
+		t.Error("deleted subscriber touched")
+	}
+	if _, found := hub.touchSubscriber(""); found {
+		t.Error("empty id touched")
+	}
+}
+
+func TestSubscribeRejectsOtherPrivateChannels(t *testing.T) {
+	var hub = newTestHub(t)
+	var alice = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	var private = privateChannelName(alice.id)
+	var response = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{private}})
+	if response.err == nil {
+		t.Error("subscribed to private channel of other subscriber")
+	}
+	var bob = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	response = hub.requestSubscriber(HubSubscriberRequest{command: SubscribeToChannels, subscriberId: bob.id, channels: []string{private}})
+	if response.err == nil {
+		t.Error("added private channel of other subscriber")
+	}
+	response = hub.requestSubscriber(HubSubscriberRequest{command: SubscribeToChannels, subscriberId: alice.id, channels: []string{private}})
+	if response.err != nil {
+		t.Errorf("adding own private channel failed: %s", response.err.Error())
+	}
+}
+
+/**
+* subscribers without requests for SubscriberKeepAlive are removed by cleanup
+*/
+func TestCleanupRemovesIdleSubscribers(t *testing.T) {
+	var clock = newFakeClock()
+	var config = newTestHubConfig(t)
+	config.Clock = clock
+	config.FeedTimeout = 24 * time.Hour
+	var hub = NewHub(config)
+	var idle = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"cleanup"}}).subscriber
+	var active = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"cleanup"}}).subscriber
+	clock.Advance(hub.config.SubscriberKeepAlive - time.Second)
+	if _, found := hub.touchSubscriber(active.id); !found {
+		t.Fatal("active subscriber removed before keep alive passed")
+	}
+	clock.Advance(2 * time.Second)
+	hub.subscriberCommandListener <- HubSubscriberRequest{command: CleanupSubscribers}
+	// touches are served after cleanup by the same process
+	if _, found := hub.touchSubscriber(idle.id); found {
+		t.Error("idle subscriber not removed")
+	}
+	if _, found := hub.touchSubscriber(active.id); !found {
+		t.Error("active subscriber removed")
+	}
+	select {
+		case <- idle.stopped:
+		case <- time.After(5 * time.Second):
+			t.Error("process of removed subscriber not stopped")
+	}
+}
+
+/**
+* subscriber which does not take waiting data within FeedTimeout unsubscribes
+*/
+func TestFeedTimeoutUnsubscribes(t *testing.T) {
+	var clock = newFakeClock()
+	var config = newTestHubConfig(t)
+	config.Clock = clock
+	// differs from periods of other hub processes
+	config.FeedTimeout = 45 * time.Second
+	var hub = NewHub(config)
+	// subscribe snapshot is waiting and never taken
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"timeout"}}).subscriber
+	clock.waitForAfter(t, config.FeedTimeout)
+	clock.Advance(hub.config.FeedTimeout - time.Second)
+	if _, found := hub.touchSubscriber(subscriber.id); !found {
+		t.Fatal("subscriber unsubscribed before feed timeout")
+	}
+	clock.Advance(2 * time.Second)
+	select {
+		case <- subscriber.stopped:
+		case <- time.After(5 * time.Second):
+			t.Fatal("subscriber process not stopped after feed timeout")
+	}
+	var deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, found := hub.touchSubscriber(subscriber.id); !found {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber not unsubscribed after feed timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/**
+* subscribe and addchannels fail with status of rejected channel, failed subscribe keeps no subscriber
+*/
+func TestSubscribeReportsRejectedChannels(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.MaxChannels = 3
+	var hub = NewHub(config)
+	// channels with data are not reclaimed - fill the limit
+	var full = false
+	for i := 0; i < 10 && !full; i++ {
+		full = hub.AddNewDataToChannel(DataCreate, fmt.Sprintf("full%d", i), "data") != nil
+	}
+	if !full {
+		t.Fatal("channel limit not reached")
+	}
+	var server = httptest.NewServer(hub)
+	defer server.Close()
+	var get = func(query string) (int, string) {
+		response, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+	if code, body := get("/subscribe?channels=full0,extra"); code != http.StatusForbidden {
+		t.Errorf("subscribe over channel limit returned %d %s, expected 403", code, body)
+	}
+	if subscribers := createHubStatus(hub).Subscribers; len(subscribers) != 0 {
+		t.Errorf("failed subscribe kept %d subscribers", len(subscribers))
+	}
+	ws, err := subscribeTestSocket(newTestWebSocketServer(t, hub), map[string]interface{}{"channels": "extra"})
+	if err == nil {
+		ws.Close()
+		t.Error("web socket subscribe over channel limit succeeded")
+	} else if !strings.Contains(err.Error(), "limit") {
+		t.Errorf("web socket subscribe failed with %s, expected channel limit", err.Error())
+	}
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"full0"}})
+	if subscriber.err != nil {
+		t.Fatal(subscriber.err)
+	}
+	if code, body := get("/addchannels?channels=extra&id=" + subscriber.subscriber.id); code != http.StatusForbidden {
+		t.Errorf("addchannels over channel limit returned %d %s, expected 403", code, body)
+	}
+}
@@ -0,0 +1,54 @@
+package comet
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+/**
+* error returned by hub operations - Code is http status sent to the client
+*/
+type HubError struct {
+	Code int
+	Message string
+}
+
+func (e *HubError) Error() string {
+	return e.Message
+}
+
+func newHubError(code int, format string, v ...interface{}) *HubError {
+	return &HubError{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+/**
+* writes err to client, using its code when it is a HubError
+*/
+func writeHubError(m DataMediator, err error) {
+	if hubError, ok := err.(*HubError); ok {
+		m.WriteError(hubError.Code, hubError.Message)
+	} else {
+		m.WriteError(http.StatusInternalServerError, err.Error())
+	}
+}
+
+// channel names are used as file names in data directory
+var channelNamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_\-.]*$`)
+
+func (h *Hub) validateChannelName(channelName string) error {
+	if len(channelName) > h.config.MaxChannelNameLength {
+		return newHubError(http.StatusBadRequest, "channel name longer than %d characters", h.config.MaxChannelNameLength)
+	}
+	if !channelNamePattern.MatchString(channelName) {
+		return newHubError(http.StatusBadRequest, "invalid channel name '%s' - allowed are letters, digits, '_', '-' and '.'", channelName)
+	}
+	return nil
+}
+
+func (h *Hub) validateDataSize(data string) error {
+	if len(data) > h.config.MaxDataSize {
+		return newHubError(http.StatusRequestEntityTooLarge, "data larger than %d bytes", h.config.MaxDataSize)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package comet
+
+import (
+	"encoding/json"
+	"sort"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* presence events sent to channels with presence enabled - data is PresenceMember json
+*/
+const (
+	PresenceJoin = "join"
+	PresenceLeave = "leave"
+)
+
+/**
+* subscriber present in a channel, identity and metadata are supplied by the client when subscribing
+* member id is created when subscriber joins the channel - subscriber id authorizes requests and is never shown to others
+*/
+type PresenceMember struct {
+	MemberId string `json:"memberId"`
+	Identity string `json:"identity"`
+	Metadata string `json:"metadata,omitempty"`
+}
+
+/**
+* adds subscriber to members of channel and tells channel subscribers it joined
+* subscriber already present only gets its metadata refreshed
+*/
+func (h *Hub) joinPresence(channelName string, s *Subscriber) {
+	var members = h.presence[channelName]
+	if members == nil {
+		members = make(map[string]PresenceMember)
+		h.presence[channelName] = members
+	}
+	member, present := members[s.id]
+	if !present {
+		var err error
+		if member.MemberId, err = newUUID(); err != nil {
+			l.Ef("presence member of %s not created: %s", channelName, err.Error())
+			return
+		}
+	}
+	member.Identity = s.identity
+	member.Metadata = s.metadata
+	members[s.id] = member
+	if !present {
+		h.publishPresence(channelName, PresenceJoin, member)
+	}
+}
+
+/**
+* removes subscriber from members of channel and tells channel subscribers it left
+*/
+func (h *Hub) leavePresence(channelName string, s *Subscriber) {
+	var members = h.presence[channelName]
+	member, present := members[s.id]
+	if !present {
+		return
+	}
+	delete(members, s.id)
+	if len(members) == 0 {
+		delete(h.presence, channelName)
+	}
+	h.publishPresence(channelName, PresenceLeave, member)
+}
+
+/**
+* sends presence event to subscribers of channel, without waiting
+* presence events have no data version
+*/
+func (h *Hub) publishPresence(channelName string, event string, member PresenceMember) {
+	data, _ := json.Marshal(member)
+	var command = SubscriberControlCommand{command: SubscriberFeed, SubscriberFeedCommand: CreateSingleFeedCommad(event, channelName, string(data), 0, "")}
+	for _, subscriber := range(h.subscribers) {
+		if subscriber.channels[channelName] == nil {
+			continue
+		}
+		select {
+			case subscriber.commandListener <- command:
+			default:
+				l.Wf("subscribers process - did not deliver %s of %s to %s - queue full", event, channelName, subscriber.id)
+		}
+	}
+}
+
+/**
+* current members of channel, ordered by identity
+*/
+func (h *Hub) presenceMembers(channelName string) []PresenceMember {
+	var result = make([]PresenceMember, 0, len(h.presence[channelName]))
+	for _, member := range(h.presence[channelName]) {
+		result = append(result, member)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Identity != result[j].Identity {
+			return result[i].Identity < result[j].Identity
+		}
+		return result[i].MemberId < result[j].MemberId
+	})
+	return result
+}
+
+/**
+* presence of channel was turned on or off by configure
+* turned on - current subscribers of channel join, turned off - members are dropped without leave events
+*/
+func (h *Hub) configurePresence(channelName string, enabled bool) {
+	if !enabled {
+		delete(h.presence, channelName)
+	}
+	for _, subscriber := range(h.subscribers) {
+		var channel = subscriber.channels[channelName]
+		if channel == nil || channel.presence == enabled {
+			continue
+		}
+		channel.presence = enabled
+		if enabled {
+			h.joinPresence(channelName, subscriber)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package comet
+
+import (
+	"testing"
+)
+
+func setTestPresence(t *testing.T, hub *Hub, channel string, enabled bool) {
+	if err := hub.ConfigureChannel(channel, func(options *ChannelOptions) { options.Presence = enabled }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPresenceMembers(hub *Hub, channel string) []PresenceMember {
+	return hub.requestSubscriber(HubSubscriberRequest{command: GetPresence, channels: []string{channel}}).members
+}
+
+/**
+* members are listed with member ids only, existing subscribers join when presence is turned on
+*/
+func TestPresenceMembers(t *testing.T) {
+	var hub = newTestHub(t)
+	var alice = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"room"}, options: SubscriptionOptions{Identity: "alice"}}).subscriber
+	if members := testPresenceMembers(hub, "room"); len(members) != 0 {
+		t.Fatalf("members %v before presence was turned on", members)
+	}
+	setTestPresence(t, hub, "room", true)
+	var bob = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"room"}, options: SubscriptionOptions{Identity: "bob"}}).subscriber
+	var members = testPresenceMembers(hub, "room")
+	if len(members) != 2 || members[0].Identity != "alice" || members[1].Identity != "bob" {
+		t.Fatalf("members %v, expected alice and bob", members)
+	}
+	for _, member := range(members) {
+		if member.MemberId == "" || member.MemberId == alice.id || member.MemberId == bob.id {
+			t.Errorf("member %s exposes subscriber id", member.MemberId)
+		}
+	}
+	// member id stays while subscriber is present
+	hub.requestSubscriber(HubSubscriberRequest{command: SubscribeToChannels, subscriberId: alice.id, channels: []string{"room"}, options: SubscriptionOptions{Identity: "alice", Metadata: "away"}})
+	if again := testPresenceMembers(hub, "room"); again[0].MemberId != members[0].MemberId || again[0].Metadata != "away" {
+		t.Errorf("member %v after rejoin, expected %s with metadata away", again[0], members[0].MemberId)
+	}
+	hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: bob.id})
+	if members = testPresenceMembers(hub, "room"); len(members) != 1 || members[0].Identity != "alice" {
+		t.Errorf("members %v after bob left, expected alice", members)
+	}
+}
+
+func TestPresenceTurnedOff(t *testing.T) {
+	var hub = newTestHub(t)
+	setTestPresence(t, hub, "room", true)
+	var alice = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"room"}, options: SubscriptionOptions{Identity: "alice"}}).subscriber
+	setTestPresence(t, hub, "room", false)
+	if members := testPresenceMembers(hub, "room"); len(members) != 0 {
+		t.Fatalf("members %v after presence was turned off", members)
+	}
+	setTestPresence(t, hub, "room", true)
+	if members := testPresenceMembers(hub, "room"); len(members) != 1 || members[0].Identity != "alice" {
+		t.Fatalf("members %v after presence was turned on again, expected alice", members)
+	}
+	hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: alice.id})
+	if members := testPresenceMembers(hub, "room"); len(members) != 0 {
+		t.Errorf("members %v after alice left", members)
+	}
+}
+
+func TestStatusWithoutSubscriberIds(t *testing.T) {
+	var hub = newTestHub(t)
+	hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"room"}, options: SubscriptionOptions{Identity: "alice"}})
+	var status = createHubStatus(hub)
+	if len(status.Subscribers) != 1 || status.Subscribers[0].Identity != "alice" {
+		t.Fatalf("status subscribers %v, expected alice", status.Subscribers)
+	}
+	if channels := status.Subscribers[0].Channels; len(channels) != 1 || channels[0] != "room" {
+		t.Errorf("status channels %v, expected room without private channel", channels)
+	}
+}
@@ -0,0 +1,137 @@
+package comet
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/**
+* fields of json channel data sent to a subscriber (fields parameter of subscription)
+* fields are dotted paths separated by comma - "symbol,quote.bid,legs.price"
+* nested objects keep their structure, paths continue into every element of arrays
+* data which is not json is sent unchanged
+*/
+type dataProjection struct {
+	// normalized fields, identifies equal projections of different subscribers
+	key string
+	fields projectionTree
+}
+
+/**
+* selected fields of an object - nil subtree selects the whole value
+*/
+type projectionTree map[string]projectionTree
+
+/**
+* parses comma separated field paths, empty fields is no projection
+*/
+func parseProjection(fields string) (*dataProjection, error) {
+	if strings.TrimSpace(fields) == "" {
+		return nil, nil
+	}
+	if len(fields) > maxFilterLength {
+		return nil, newHubError(http.StatusBadRequest, "fields longer than %d characters", maxFilterLength)
+	}
+	var paths = make([]string, 0)
+	for _, path := range(strings.Split(fields, ",")) {
+		path = strings.TrimSpace(path)
+		for _, name := range(strings.Split(path, ".")) {
+			if name == "" {
+				return nil, newHubError(http.StatusBadRequest, "invalid field '%s'", path)
+			}
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var tree = make(projectionTree)
+	for _, path := range(paths) {
+		var node = tree
+		var names = strings.Split(path, ".")
+		for i, name := range(names) {
+			child, found := node[name]
+			if found && child == nil {
+				// parent field is already selected as a whole
+				break
+			}
+			if i == len(names) - 1 {
+				node[name] = nil
+				break
+			}
+			if !found {
+				child = make(projectionTree)
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return &dataProjection{key: strings.Join(paths, ","), fields: tree}, nil
+}
+
+/**
+* selected fields of json data
+*/
+func (p *dataProjection) project(data string) string {
+	var decoder = json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if decoder.Decode(&value) != nil || decoder.More() {
+		return data
+	}
+	projected, _ := p.fields.project(value)
+	var buffer bytes.Buffer
+	var encoder = json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if encoder.Encode(projected) != nil {
+		return data
+	}
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+/**
+* selected part of value, false if value has none of the fields
+*/
+func (t projectionTree) project(value interface{}) (interface{}, bool) {
+	switch typed := value.(type) {
+		case map[string]interface{}:
+			var result = make(map[string]interface{})
+			for name, subtree := range(t) {
+				field, found := typed[name]
+				if !found {
+					continue
+				}
+				if subtree == nil {
+					result[name] = field
+				} else if projected, ok := subtree.project(field); ok {
+					result[name] = projected
+				}
+			}
+			return result, true
+		case []interface{}:
+			var result = make([]interface{}, 0, len(typed))
+			for _, element := range(typed) {
+				if projected, ok := t.project(element); ok {
+					result = append(result, projected)
+				}
+			}
+			return result, true
+	}
+	return nil, false
+}
+
+/**
+* projects data of create and update commands
+*/
+func (p *dataProjection) projectCommands(commands []SubscriberResponseCommand) []SubscriberResponseCommand {
+	if p == nil {
+		return commands
+	}
+	for i := range(commands) {
+		if commands[i].Command == DataCreate || commands[i].Command == DataUpdate {
+			commands[i].Data = p.project(commands[i].Data)
+		}
+	}
+	return commands
+}
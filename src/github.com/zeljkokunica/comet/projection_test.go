@@ -0,0 +1,97 @@
+package comet
+
+import (
+	"testing"
+)
+
+func TestParseProjection(t *testing.T) {
+	if projection, err := parseProjection(" "); projection != nil || err != nil {
+		t.Errorf("empty fields parsed as %v %v, expected no projection", projection, err)
+	}
+	for _, fields := range([]string{"a..b", "a,", ".a", "a,,b"}) {
+		if _, err := parseProjection(fields); err == nil {
+			t.Errorf("fields %q parsed without error", fields)
+		}
+	}
+	first, _ := parseProjection("quote.bid, symbol")
+	second, _ := parseProjection("symbol,quote.bid")
+	if first.key != second.key {
+		t.Errorf("equal projections have keys %q and %q", first.key, second.key)
+	}
+}
+
+func TestProjectData(t *testing.T) {
+	var data = `{"symbol":"ACME","quote":{"bid":1.5,"ask":1.6},"legs":[{"price":1,"size":2},{"size":3},5],"note":"<b>"}`
+	for _, check := range([]struct {
+		fields string
+		expected string
+	}{
+		{"symbol", `{"symbol":"ACME"}`},
+		{"quote.bid,symbol", `{"quote":{"bid":1.5},"symbol":"ACME"}`},
+		{"quote,quote.bid", `{"quote":{"ask":1.6,"bid":1.5}}`},
+		{"legs.price", `{"legs":[{"price":1},{}]}`},
+		{"note,missing", `{"note":"<b>"}`},
+		{"symbol.name", `{}`},
+	}) {
+		projection, _ := parseProjection(check.fields)
+		if projected := projection.project(data); projected != check.expected {
+			t.Errorf("fields %s projected %s, expected %s", check.fields, projected, check.expected)
+		}
+	}
+	var projection, _ = parseProjection("symbol")
+	for _, data := range([]string{"plain text", `{"symbol":"A"} {"symbol":"B"}`}) {
+		if projected := projection.project(data); projected != data {
+			t.Errorf("data %q which is not json projected to %q", data, projected)
+		}
+	}
+}
+
+func subscribeTestProjection(t *testing.T, hub *Hub, channel string, fields string) Subscriber {
+	projection, err := parseProjection(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{channel}, options: SubscriptionOptions{Mode: SubscriptionSnapshot, Fields: fields, projection: projection}})
+	if response.err != nil {
+		t.Fatal(response.err)
+	}
+	return response.subscriber
+}
+
+/**
+* snapshot and later updates are projected - projected update is cached by projection key,
+* subscribers with different projections must still get their own fields
+*/
+func TestSubscriptionProjectsData(t *testing.T) {
+	var hub = newTestHub(t)
+	if err := hub.AddNewDataToChannel(DataCreate, "quotes", `{"symbol":"ACME","bid":1,"ask":2}`); err != nil {
+		t.Fatal(err)
+	}
+	var subscribers = []struct {
+		fields string
+		snapshot string
+		update string
+	}{
+		{"symbol,bid", `{"bid":1,"symbol":"ACME"}`, `{"bid":3,"symbol":"ACME"}`},
+		{"bid, symbol", `{"bid":1,"symbol":"ACME"}`, `{"bid":3,"symbol":"ACME"}`},
+		{"ask", `{"ask":2}`, `{"ask":4}`},
+		{"", `{"symbol":"ACME","bid":1,"ask":2}`, `{"symbol":"ACME","bid":3,"ask":4}`},
+	}
+	var created = make([]Subscriber, len(subscribers))
+	for i, check := range(subscribers) {
+		created[i] = subscribeTestProjection(t, hub, "quotes", check.fields)
+		var commands = receiveTestFeed(t, created[i], "quotes")
+		if len(commands) != 1 || commands[0].Command != DataCreate || commands[0].Data != check.snapshot {
+			t.Errorf("fields %q snapshot %v, expected %s", check.fields, commands, check.snapshot)
+		}
+	}
+	if err := hub.AddNewDataToChannel(DataUpdate, "quotes", `{"symbol":"ACME","bid":3,"ask":4}`); err != nil {
+		t.Fatal(err)
+	}
+	for i, check := range(subscribers) {
+		var commands = receiveTestFeed(t, created[i], "quotes")
+		if len(commands) != 1 || commands[0].Command != DataUpdate || commands[0].Data != check.update {
+			t.Errorf("fields %q update %v, expected %s", check.fields, commands, check.update)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package comet
+
+import (
+	"testing"
+	"time"
+)
+
+/**
+* takes feed of subscriber until it has commands of channel, fails after a second
+*/
+func receiveTestFeed(t *testing.T, subscriber Subscriber, channel string) []SubscriberResponseCommand {
+	var timeout = time.After(time.Second)
+	for {
+		select {
+			case command := <- subscriber.feedListener:
+				var commands = make([]SubscriberResponseCommand, 0)
+				for _, data := range(command.data) {
+					if data.Channel == channel {
+						commands = append(commands, data)
+					}
+				}
+				if len(commands) > 0 {
+					return commands
+				}
+			case <- timeout:
+				t.Fatalf("subscriber %s did not receive data of %s", subscriber.id, channel)
+				return nil
+		}
+	}
+}
+
+/**
+* published data carries publisher id, never subscriber id of the publisher
+*/
+func TestPublishStampsPublisherId(t *testing.T) {
+	var hub = newTestHub(t)
+	if err := hub.ConfigureChannel("chat", func(options *ChannelOptions) { options.ClientPublish = true }); err != nil {
+		t.Fatal(err)
+	}
+	var publisher = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"chat"}, options: SubscriptionOptions{Mode: SubscriptionDeltas}}).subscriber
+	var reader = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"chat"}, options: SubscriptionOptions{Mode: SubscriptionDeltas}}).subscriber
+	if publisher.publisherId == "" || publisher.publisherId == publisher.id {
+		t.Fatalf("publisher id %s, expected id other than subscriber id", publisher.publisherId)
+	}
+	if err := hub.PublishToChannel(DataUpdate, "chat", "hello", publisher.publisherId, false); err != nil {
+		t.Fatal(err)
+	}
+	var commands = receiveTestFeed(t, reader, "chat")
+	if len(commands) != 1 || commands[0].Publisher != publisher.publisherId {
+		t.Fatalf("received %v, expected update from %s", commands, publisher.publisherId)
+	}
+	// without echo publisher gets nothing, next update shows it did not receive its own
+	hub.AddNewDataToChannel(DataUpdate, "chat", "server")
+	if commands = receiveTestFeed(t, publisher, "chat"); len(commands) != 1 || commands[0].Data != "server" {
+		t.Errorf("publisher received %v, expected only server update", commands)
+	}
+	channel, err := hub.getChannelData("chat", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, update := range(channel.Updates) {
+		if update.Publisher == publisher.id {
+			t.Errorf("stored update %v carries subscriber id", update)
+		}
+	}
+}
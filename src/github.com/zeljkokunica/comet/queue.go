@@ -0,0 +1,308 @@
+package comet
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* dispatch policies of queue channels (configure?channel=...&queue=...)
+* data published to a queue channel is not stored, each item is delivered to exactly one consumer
+*/
+const (
+	QueueRoundRobin = "roundrobin"
+	QueueLeastLoaded = "leastloaded"
+	// configure value turning queue off
+	QueueOff = "off"
+)
+
+/**
+* command delivering queue item to consumer, correlationId is the item id used for ack/nack
+*/
+const QueueItemCommand = "item"
+
+const (
+	queueEnqueue = 1
+	queueAck = 2
+	queueNack = 3
+	queueConsumerJoin = 4
+	queueConsumerLeave = 5
+	queueStatus = 6
+)
+
+type queueItem struct {
+	// publishing order, item id is its string form
+	sequence int64
+	id string
+	data string
+	contentType string
+	publisher string
+	deliveries int
+}
+
+type inFlightItem struct {
+	item queueItem
+	consumer string
+	deadline time.Time
+}
+
+/**
+* items and consumers of a queue channel, owned by queues process
+*/
+type workQueue struct {
+	channelName string
+	dispatch string
+	pending []queueItem
+	inFlight map[string]*inFlightItem
+	// consumer ids in order of joining, round robin continues after next
+	consumers []string
+	load map[string]int
+	next int
+}
+
+type queueProcessCommand struct {
+	command int
+	channelName string
+	dispatch string
+	item queueItem
+	subscriberId string
+	requeue bool
+	responseListener chan queueProcessResponse
+}
+
+type queueProcessResponse struct {
+	err error
+	status []HubStatusQueue
+}
+
+/**
+* distributes queue items to consumers, handles acks and redelivers items of timed out or leaving consumers
+* items are handed to subscribers process only while it takes them - subscribers process sends consumer
+* changes here, so waiting for it would deadlock
+*/
+func (h *Hub) queuesProcess() {
+	l.I("queues process - start")
+	defer l.I("queues process - end")
+	var queues = make(map[string]*workQueue)
+	var sequence int64
+	var timeoutCheck = h.config.Clock.After(h.config.ExpiryCheckPeriod)
+	var deliveries = make([]ChannelDataOperation, 0)
+	for {
+		// nil channel disables delivering while there is nothing to deliver
+		var deliveryListener chan ChannelDataOperation
+		var delivery ChannelDataOperation
+		if len(deliveries) > 0 {
+			deliveryListener = h.subscriberFeedListener
+			delivery = deliveries[0]
+		}
+		select {
+			case deliveryListener <- delivery:
+				deliveries = deliveries[1:]
+			case command := <- h.queueListener:
+				var queue = queues[command.channelName]
+				if queue == nil {
+					queue = &workQueue{channelName: command.channelName, dispatch: command.dispatch, pending: make([]queueItem, 0), inFlight: make(map[string]*inFlightItem), consumers: make([]string, 0), load: make(map[string]int)}
+				}
+				var response queueProcessResponse
+				switch command.command {
+					case queueEnqueue:
+						if len(queue.pending) >= maxQueueItems {
+							response.err = newHubError(http.StatusServiceUnavailable, "queue %s is full", queue.channelName)
+							break
+						}
+						sequence++
+						command.item.sequence = sequence
+						command.item.id = strconv.FormatInt(sequence, 10)
+						queue.dispatch = command.dispatch
+						queue.pending = append(queue.pending, command.item)
+					case queueAck, queueNack:
+						var inFlight = queue.inFlight[command.item.id]
+						if inFlight == nil || inFlight.consumer != command.subscriberId {
+							response.err = newHubError(http.StatusNotFound, "item %s is not delivered to %s", command.item.id, command.subscriberId)
+							break
+						}
+						queue.release(command.item.id)
+						if command.command == queueNack && command.requeue {
+							queue.requeue(inFlight.item)
+						}
+					case queueConsumerJoin:
+						queue.dispatch = command.dispatch
+						queue.join(command.subscriberId)
+					case queueConsumerLeave:
+						queue.leave(command.subscriberId)
+					case queueStatus:
+						response.status = queuesStatus(queues)
+				}
+				if command.responseListener != nil {
+					command.responseListener <- response
+				}
+				deliveries = h.dispatchQueue(queue, deliveries)
+				if len(queue.pending) == 0 && len(queue.inFlight) == 0 && len(queue.consumers) == 0 {
+					delete(queues, queue.channelName)
+				} else {
+					queues[queue.channelName] = queue
+				}
+			case now := <- timeoutCheck:
+				timeoutCheck = h.config.Clock.After(h.config.ExpiryCheckPeriod)
+				for _, queue := range(queues) {
+					for id, inFlight := range(queue.inFlight) {
+						if now.After(inFlight.deadline) {
+							l.Wf("queues process - item %s of %s not acknowledged by %s", id, queue.channelName, inFlight.consumer)
+							queue.release(id)
+							queue.requeue(inFlight.item)
+						}
+					}
+					deliveries = h.dispatchQueue(queue, deliveries)
+				}
+		}
+	}
+}
+
+/**
+* assigns pending items while some consumer can take more, returns deliveries with the assigned items added
+*/
+func (h *Hub) dispatchQueue(queue *workQueue, deliveries []ChannelDataOperation) []ChannelDataOperation {
+	for len(queue.pending) > 0 {
+		var consumer = queue.nextConsumer()
+		if consumer == "" {
+			break
+		}
+		var item = queue.pending[0]
+		queue.pending = queue.pending[1:]
+		item.deliveries++
+		queue.inFlight[item.id] = &inFlightItem{item: item, consumer: consumer, deadline: h.config.Clock.Now().Add(h.config.QueueAckTimeout)}
+		queue.load[consumer]++
+		deliveries = append(deliveries, ChannelDataOperation{operation: QueueItemCommand, channelData: ChannelData{ChannelName: queue.channelName, Data: item.data, Publisher: item.publisher}, contentType: item.contentType, correlationId: item.id, subscriberId: consumer})
+	}
+	return deliveries
+}
+
+/**
+* consumer which gets the next item, empty when all consumers are busy
+*/
+func (q *workQueue) nextConsumer() string {
+	var selected = ""
+	for i := 0; i < len(q.consumers); i++ {
+		var index = (q.next + i) % len(q.consumers)
+		var consumer = q.consumers[index]
+		if q.load[consumer] >= maxQueueItemsPerConsumer {
+			continue
+		}
+		if q.dispatch != QueueLeastLoaded {
+			q.next = index + 1
+			return consumer
+		}
+		if selected == "" || q.load[consumer] < q.load[selected] {
+			selected = consumer
+		}
+	}
+	return selected
+}
+
+func (q *workQueue) release(itemId string) {
+	var inFlight = q.inFlight[itemId]
+	delete(q.inFlight, itemId)
+	if _, found := q.load[inFlight.consumer]; found {
+		q.load[inFlight.consumer]--
+	}
+}
+
+/**
+* puts item back to the front of the queue, item delivered too many times is dropped
+*/
+func (q *workQueue) requeue(item queueItem) {
+	if item.deliveries >= maxQueueDeliveries {
+		l.Wf("queues process - item %s of %s dropped after %d deliveries", item.id, q.channelName, item.deliveries)
+		return
+	}
+	q.pending = append([]queueItem{item}, q.pending...)
+}
+
+func (q *workQueue) join(consumer string) {
+	if _, found := q.load[consumer]; found {
+		return
+	}
+	q.consumers = append(q.consumers, consumer)
+	q.load[consumer] = 0
+}
+
+/**
+* removes consumer, its unacknowledged items are redelivered
+*/
+func (q *workQueue) leave(consumer string) {
+	if _, found := q.load[consumer]; !found {
+		return
+	}
+	delete(q.load, consumer)
+	for i, id := range(q.consumers) {
+		if id == consumer {
+			q.consumers = append(q.consumers[:i], q.consumers[i + 1:]...)
+			break
+		}
+	}
+	var returned = make([]queueItem, 0)
+	for id, inFlight := range(q.inFlight) {
+		if inFlight.consumer == consumer {
+			delete(q.inFlight, id)
+			returned = append(returned, inFlight.item)
+		}
+	}
+	// keep publishing order of returned items
+	sort.Slice(returned, func(i, j int) bool { return returned[i].sequence < returned[j].sequence })
+	for i := len(returned) - 1; i >= 0; i-- {
+		q.requeue(returned[i])
+	}
+}
+
+func queuesStatus(queues map[string]*workQueue) []HubStatusQueue {
+	var result = make([]HubStatusQueue, 0, len(queues))
+	for _, queue := range(queues) {
+		result = append(result, HubStatusQueue{ChannelName: queue.channelName, Pending: len(queue.pending), InFlight: len(queue.inFlight), Consumers: len(queue.consumers)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ChannelName < result[j].ChannelName })
+	return result
+}
+
+func (h *Hub) queueProcess(command queueProcessCommand) queueProcessResponse {
+	var responseListener = make(chan queueProcessResponse)
+	defer close(responseListener)
+	command.responseListener = responseListener
+	h.queueListener <- command
+	return <- responseListener
+}
+
+/**
+* consumer confirms item was processed (ack), or returns it (nack, requeue=false drops it)
+* parameters: id - consumer, channel, item, requeue (nack only, true by default)
+*/
+func (h *Hub) onAckRequest(m DataMediator, command int) {
+	var request = queueProcessCommand{command: command, channelName: m.ReadParameter("channel"), subscriberId: m.ReadParameter("id"), item: queueItem{id: m.ReadParameter("item")}, requeue: true}
+	if request.subscriberId == "" || request.item.id == "" {
+		m.WriteError(http.StatusBadRequest, "consumer id and item must be set")
+		return
+	}
+	if err := h.validateChannelName(request.channelName); err != nil {
+		writeHubError(m, err)
+		return
+	}
+	if requeue := m.ReadParameter("requeue"); requeue != "" {
+		value, err := strconv.ParseBool(requeue)
+		if err != nil {
+			m.WriteError(http.StatusBadRequest, "requeue must be true or false")
+			return
+		}
+		request.requeue = value
+	}
+	if response := h.queueProcess(request); response.err != nil {
+		writeHubError(m, response.err)
+		return
+	}
+	var name = "ack"
+	if command == queueNack {
+		name = "nack"
+	}
+	m.WriteResponse(map[string]interface{}{"command": name, "channel": request.channelName, "item": request.item.id}, "json")
+}
@@ -0,0 +1,106 @@
+package comet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+* consumers join and leave while items are published - with short listener queues both processes
+* wait for each other when delivering blocks
+*/
+func TestQueueConsumersChangeWhilePublishing(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.ListenerQueueSize = 1
+	var hub = NewHub(config)
+	if err := hub.ConfigureChannel("jobs", func(options *ChannelOptions) { options.Queue = QueueRoundRobin }); err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan bool)
+	go func() {
+		defer close(done)
+		var wait sync.WaitGroup
+		for worker := 0; worker < 10; worker++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for i := 0; i < 20; i++ {
+					var consumer = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"jobs"}})
+					hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: consumer.subscriber.id})
+				}
+			}()
+		}
+		for i := 0; i < 500; i++ {
+			hub.AddNewDataToChannel(DataUpdate, "jobs", fmt.Sprintf("%d", i))
+		}
+		wait.Wait()
+	}()
+	select {
+		case <- done:
+		case <- time.After(20 * time.Second):
+			t.Fatal("publishing and consumer changes did not complete")
+	}
+	// queues process still serves
+	hub.queueProcess(queueProcessCommand{command: queueStatus})
+}
+
+/**
+* next queue item received by consumer, snapshot of channel is skipped
+*/
+func receiveTestItem(t *testing.T, consumer Subscriber) SubscriberResponseCommand {
+	for {
+		for _, command := range(receiveTestFeed(t, consumer, "jobs")) {
+			if command.Command == QueueItemCommand {
+				return command
+			}
+		}
+	}
+}
+
+/**
+* items go to consumers in turn, unacknowledged items of leaving consumer go to the next one
+*/
+func TestQueueDeliversToConsumers(t *testing.T) {
+	var hub = newTestHub(t)
+	if err := hub.ConfigureChannel("jobs", func(options *ChannelOptions) { options.Queue = QueueRoundRobin }); err != nil {
+		t.Fatal(err)
+	}
+	var first = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"jobs"}}).subscriber
+	var second = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"jobs"}}).subscriber
+	hub.AddNewDataToChannel(DataUpdate, "jobs", "a")
+	hub.AddNewDataToChannel(DataUpdate, "jobs", "b")
+	var items = map[string]string{}
+	for _, consumer := range([]Subscriber{first, second}) {
+		items[consumer.id] = receiveTestItem(t, consumer).Data
+	}
+	if items[first.id] == items[second.id] {
+		t.Fatalf("both consumers received %s", items[first.id])
+	}
+	hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: first.id})
+	if item := receiveTestItem(t, second); item.Data != items[first.id] {
+		t.Errorf("second consumer received %v, expected redelivered %s", item, items[first.id])
+	}
+}
+
+/**
+* item not acknowledged within QueueAckTimeout is delivered again
+*/
+func TestQueueRedeliversExpiredItems(t *testing.T) {
+	var clock = newFakeClock()
+	var config = newTestHubConfig(t)
+	config.Clock = clock
+	config.FeedTimeout = 24 * time.Hour
+	var hub = NewHub(config)
+	if err := hub.ConfigureChannel("jobs", func(options *ChannelOptions) { options.Queue = QueueRoundRobin }); err != nil {
+		t.Fatal(err)
+	}
+	var consumer = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"jobs"}}).subscriber
+	hub.AddNewDataToChannel(DataUpdate, "jobs", "expiring")
+	var item = receiveTestItem(t, consumer)
+	clock.Advance(hub.config.QueueAckTimeout + hub.config.ExpiryCheckPeriod)
+	if redelivered := receiveTestItem(t, consumer); redelivered.Data != item.Data {
+		t.Errorf("redelivered %v, expected %s", redelivered, item.Data)
+	}
+}
@@ -0,0 +1,93 @@
+package comet
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+* token bucket limit - Rate tokens are added per second, up to Burst tokens
+* Rate 0 disables the limit
+*/
+type RateLimit struct {
+	Rate float64 `json:"rate" yaml:"rate" toml:"rate"`
+	Burst int `json:"burst" yaml:"burst" toml:"burst"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	lastTime time.Time
+}
+
+/**
+* token buckets for a set of keys (remote address, subscriber id, channel name...)
+*/
+type RateLimiter struct {
+	lock sync.Mutex
+	limit RateLimit
+	buckets map[string]*tokenBucket
+	limited int64
+	clock Clock
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: make(map[string]*tokenBucket), clock: SystemClock{}}
+}
+
+/**
+* takes a token for key, returns false when bucket is empty
+*/
+func (r *RateLimiter) Allow(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.limit.Rate <= 0 {
+		return true
+	}
+	var now = r.clock.Now()
+	var bucket = r.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(r.limit.Burst), lastTime: now}
+		r.buckets[key] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.lastTime).Seconds() * r.limit.Rate
+		if bucket.tokens > float64(r.limit.Burst) {
+			bucket.tokens = float64(r.limit.Burst)
+		}
+		bucket.lastTime = now
+	}
+	if bucket.tokens < 1 {
+		r.limited++
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (r *RateLimiter) SetLimit(limit RateLimit) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.limit = limit
+}
+
+/**
+* number of rejected requests
+*/
+func (r *RateLimiter) Limited() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.limited
+}
+
+/**
+* removes buckets that are full again - they behave the same as new ones
+*/
+func (r *RateLimiter) cleanup() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var now = r.clock.Now()
+	for key, bucket := range(r.buckets) {
+		if r.limit.Rate <= 0 || bucket.tokens + now.Sub(bucket.lastTime).Seconds() * r.limit.Rate >= float64(r.limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package comet
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limit RateLimit) (*RateLimiter, *fakeClock) {
+	var clock = newFakeClock()
+	var limiter = NewRateLimiter(limit)
+	limiter.clock = clock
+	return limiter, clock
+}
+
+func TestRateLimitsOffByDefault(t *testing.T) {
+	perAddress, perSubscriber, perChannel := DefaultRateLimits()
+	for _, limit := range([]RateLimit{perAddress, perSubscriber, perChannel}) {
+		if limit.Rate != 0 {
+			t.Errorf("default limit %v, expected rate 0", limit)
+		}
+	}
+	limiter, _ := newTestLimiter(perAddress)
+	for i := 0; i < 10000; i++ {
+		if !limiter.Allow("feeder") {
+			t.Fatalf("request %d limited with default limits", i)
+		}
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	limiter, _ := newTestLimiter(RateLimit{Rate: 1, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("a") {
+			t.Fatalf("request %d within burst limited", i)
+		}
+	}
+	if limiter.Allow("a") {
+		t.Error("request over burst allowed")
+	}
+	if limiter.Limited() != 1 {
+		t.Errorf("limited %d, expected 1", limiter.Limited())
+	}
+	if !limiter.Allow("b") {
+		t.Error("other key limited")
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	limiter, clock := newTestLimiter(RateLimit{Rate: 2, Burst: 4})
+	for limiter.Allow("a") {
+	}
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("a") {
+			t.Fatalf("refilled request %d limited", i)
+		}
+	}
+	if limiter.Allow("a") {
+		t.Error("request over refilled tokens allowed")
+	}
+	// refill is capped by burst
+	clock.Advance(time.Hour)
+	var allowed = 0
+	for limiter.Allow("a") {
+		allowed++
+	}
+	if allowed != 4 {
+		t.Errorf("allowed %d after long pause, expected burst 4", allowed)
+	}
+}
+
+func TestRateLimitChange(t *testing.T) {
+	limiter, _ := newTestLimiter(RateLimit{Rate: 1, Burst: 1})
+	limiter.Allow("a")
+	if limiter.Allow("a") {
+		t.Fatal("request over burst allowed")
+	}
+	limiter.SetLimit(RateLimit{})
+	if !limiter.Allow("a") {
+		t.Error("request limited after limit was disabled")
+	}
+}
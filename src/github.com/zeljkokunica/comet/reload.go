@@ -0,0 +1,79 @@
+package comet
+
+import (
+	"net/http"
+	"sync"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* settings changed by configuration reload
+*/
+type ReloadResult struct {
+	// applied to running hub
+	Applied []string `json:"applied"`
+	// changed, but used only after restart
+	RestartRequired []string `json:"restartRequired"`
+}
+
+/**
+* reloads configuration of the application running the hub
+*/
+type ReloadHandler func() (ReloadResult, error)
+
+type hubReloader struct {
+	// also keeps reloads from running at the same time
+	lock sync.Mutex
+	handler ReloadHandler
+}
+
+/**
+* sets handler called by reload request, nil disables reload request
+*/
+func (h *Hub) SetReloadHandler(handler ReloadHandler) {
+	h.reloader.lock.Lock()
+	defer h.reloader.lock.Unlock()
+	h.reloader.handler = handler
+}
+
+/**
+* reloads configuration through reload handler
+*/
+func (h *Hub) Reload() (ReloadResult, error) {
+	h.reloader.lock.Lock()
+	defer h.reloader.lock.Unlock()
+	if h.reloader.handler == nil {
+		return ReloadResult{}, newHubError(http.StatusNotFound, "reload is not supported")
+	}
+	result, err := h.reloader.handler()
+	if err != nil {
+		l.Ef("reload failed: %s", err.Error())
+		return result, err
+	}
+	l.If("reload - applied %v, restart required for %v", result.Applied, result.RestartRequired)
+	return result, nil
+}
+
+/**
+* reloads configuration, responds with applied settings and settings requiring restart
+* request is disabled until admin keys are configured, errors of reload reveal configuration
+*/
+func (h *Hub) onReloadRequest(m DataMediator) {
+	h.access.lock.RLock()
+	var adminKeys = len(h.access.auth.AdminKeys)
+	h.access.lock.RUnlock()
+	if adminKeys == 0 {
+		writeHubError(m, newHubError(http.StatusNotFound, "reload request needs admin keys"))
+		return
+	}
+	result, err := h.Reload()
+	if err != nil {
+		// errors of handler are problems of reloaded configuration
+		if _, isHubError := err.(*HubError); !isHubError {
+			err = newHubError(http.StatusBadRequest, "%s", err.Error())
+		}
+		writeHubError(m, err)
+		return
+	}
+	m.WriteResponse(result, "json")
+}
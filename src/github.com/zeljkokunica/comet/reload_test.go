@@ -0,0 +1,38 @@
+package comet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func requestTestReload(hub *Hub, key string) int {
+	var recorder = httptest.NewRecorder()
+	hub.ServeHTTP(recorder, httptest.NewRequest("GET", "/reload?key=" + key, nil))
+	return recorder.Code
+}
+
+/**
+* reload request needs admin keys - without them it is not served even when other keys are open
+*/
+func TestReloadRequestNeedsAdminKey(t *testing.T) {
+	var hub = newTestHub(t)
+	var reloads = 0
+	hub.SetReloadHandler(func() (ReloadResult, error) {
+		reloads++
+		return ReloadResult{Applied: []string{}, RestartRequired: []string{}}, nil
+	})
+	if code := requestTestReload(hub, ""); code != http.StatusNotFound {
+		t.Errorf("reload without admin keys returned %d, expected 404", code)
+	}
+	hub.SetAuth(AuthConfig{AdminKeys: []string{"admin"}})
+	if code := requestTestReload(hub, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("reload with wrong key returned %d, expected 401", code)
+	}
+	if code := requestTestReload(hub, "admin"); code != http.StatusOK {
+		t.Errorf("reload with admin key returned %d, expected 200", code)
+	}
+	if reloads != 1 {
+		t.Errorf("reloaded %d times, expected once", reloads)
+	}
+}
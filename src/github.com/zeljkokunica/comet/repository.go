@@ -5,8 +5,11 @@ import (
 	"io/ioutil"
 	"encoding/json"
 	"log"
-	"time"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 type DataOperation string
 
@@ -14,11 +17,21 @@ const (
 	DataClear = "clear"
 	DataCreate = "create"
 	DataUpdate = "update"
+	DataConfigure = "configure"
 )
 
+/**
+* sent by channels process to data process of a channel nobody is subscribed to
+* data process of a channel without data and options ends
+*/
+const channelReclaim = "reclaim"
+
 type HubRepositoryChannelFeeds struct {
 	newDataListener chan ChannelDataInputCommand
 	getDataListener chan ChannelDataRequestCommand
+	// closed when channel is removed - feeds must be requested again
+	stopped chan bool
+	err error
 }
 
 type HubRepositoryChannelGetCommand struct {
@@ -33,26 +46,54 @@ type HubRepository struct {
 	channels map[string]*Channel
 	newDataListener map[string]chan ChannelDataInputCommand
 	getDataListener map[string]chan ChannelDataRequestCommand
+	stopListener map[string]chan bool
 	getChannelListener chan HubRepositoryChannelGetCommand
+	removeChannelListener chan string
+	// channels somebody is subscribed to, other channels without data are removed
+	reclaimListener chan map[string]bool
+	// channels for hub status
+	statusListener chan chan []HubStatusChannel
+	// private channels do not count into MaxChannels of hub config, they are removed with their subscriber
+	privateChannels int
+	maxChannels int
+	// time of channel data
+	clock Clock
+	// directory of saved channels
+	dataDir string
+	listenerQueueSize int
+	// changed while hub is running, applied on next update of a channel
+	retentionLock sync.RWMutex
+	retention ChannelRetention
 }
 
-func NewHubRepository() *HubRepository {
+func NewHubRepository(config HubConfig) *HubRepository {
 	var repository = new (HubRepository)
+	repository.clock = config.Clock
+	repository.dataDir = config.DataDir
+	repository.listenerQueueSize = config.ListenerQueueSize
+	repository.maxChannels = config.MaxChannels
 	repository.channels = make(map[string]*Channel)
-	repository.getChannelListener = make(chan HubRepositoryChannelGetCommand, expectedMaxSubscribers)
-	repository.newDataListener = make(map[string]chan ChannelDataInputCommand, expectedMaxSubscribers)
-	repository.getDataListener = make(map[string]chan ChannelDataRequestCommand, expectedMaxSubscribers)
-	if restoreData {
+	repository.getChannelListener = make(chan HubRepositoryChannelGetCommand, repository.listenerQueueSize)
+	repository.newDataListener = make(map[string]chan ChannelDataInputCommand, repository.listenerQueueSize)
+	repository.getDataListener = make(map[string]chan ChannelDataRequestCommand, repository.listenerQueueSize)
+	repository.stopListener = make(map[string]chan bool, repository.listenerQueueSize)
+	repository.removeChannelListener = make(chan string, repository.listenerQueueSize)
+	repository.reclaimListener = make(chan map[string]bool, 1)
+	repository.statusListener = make(chan chan []HubStatusChannel)
+	if err := os.MkdirAll(repository.dataDir, 0755); err != nil {
+		l.Ef("could not create data directory %s: %s", repository.dataDir, err.Error())
+	}
+	if !config.SkipRestore {
 		l.I("restoring channels")
 		// read previous data
-		var files, err = ioutil.ReadDir("data")
+		var files, err = ioutil.ReadDir(repository.dataDir)
 		if err == nil {
 			for i := 0; i < len(files); i++ {
 				var file = files[i]
 				if !strings.HasSuffix(file.Name(), ".json") {
 					continue
 				}
-				var data, err = ioutil.ReadFile("data/" + file.Name())
+				var data, err = ioutil.ReadFile(filepath.Join(repository.dataDir, file.Name()))
 				if err == nil {
 					l.If("restoring channel %s", file.Name())
 					var channel = new (Channel)
@@ -78,17 +119,95 @@ func (r *HubRepository) addCreatedChannel(channel *Channel) {
 		return
 	}
 	
+	if strings.HasPrefix(channel.ChannelName, "private_") {
+		r.privateChannels++
+	}
 	r.channels[channel.ChannelName] = channel
-	r.newDataListener[channel.ChannelName] = make(chan ChannelDataInputCommand, 10)
-	r.getDataListener[channel.ChannelName] = make(chan ChannelDataRequestCommand, expectedMaxSubscribers)
-	go r.dataProcess(channel.ChannelName)
+	// unbuffered - command is either taken by data process or sender sees the channel stopped
+	r.newDataListener[channel.ChannelName] = make(chan ChannelDataInputCommand)
+	r.getDataListener[channel.ChannelName] = make(chan ChannelDataRequestCommand)
+	r.stopListener[channel.ChannelName] = make(chan bool)
+	var feeds = HubRepositoryChannelFeeds{newDataListener: r.newDataListener[channel.ChannelName], getDataListener: r.getDataListener[channel.ChannelName]}
+	go r.dataProcess(channel, feeds, r.stopListener[channel.ChannelName])
+}
+
+/**
+* stops dataProcess of a channel and forgets the channel
+*/
+func (r *HubRepository) removeChannel(channelName string) {
+	if stopListener, found := r.stopListener[channelName]; found {
+		close(stopListener)
+		if strings.HasPrefix(channelName, "private_") {
+			r.privateChannels--
+		}
+	}
+	delete(r.channels, channelName)
+	delete(r.newDataListener, channelName)
+	delete(r.getDataListener, channelName)
+	delete(r.stopListener, channelName)
+}
+
+/**
+* removes channels without data and options that nobody is subscribed to
+*/
+func (r *HubRepository) reclaimChannels(subscribed map[string]bool) {
+	var reclaimed = 0
+	for channelName, newDataListener := range(r.newDataListener) {
+		if subscribed[channelName] || strings.HasPrefix(channelName, "private_") {
+			continue
+		}
+		var responseListener = make(chan ChannelDataOperation)
+		newDataListener <- ChannelDataInputCommand{Command: channelReclaim, ChannelName: channelName, responseListener: responseListener}
+		if response := <- responseListener; response.operation == channelReclaim {
+			r.removeChannel(channelName)
+			reclaimed++
+		}
+	}
+	if reclaimed > 0 {
+		l.If("channels process - reclaimed %d empty channels", reclaimed)
+	}
+}
+
+func (r *HubRepository) channelRetention() ChannelRetention {
+	r.retentionLock.RLock()
+	defer r.retentionLock.RUnlock()
+	return r.retention
+}
+
+func (r *HubRepository) setRetention(retention ChannelRetention) {
+	r.retentionLock.Lock()
+	defer r.retentionLock.Unlock()
+	r.retention = retention
 }
 
 func (r *HubRepository) channelProcess() {
 	l.I("channels process - start")
 	for {
-		var channelRequest = <- r.getChannelListener
+		var channelRequest HubRepositoryChannelGetCommand
+		select {
+			case channelRequest = <- r.getChannelListener:
+			case channelName := <- r.removeChannelListener:
+				l.If("channels process - remove channel %s", channelName);
+				r.removeChannel(channelName)
+				continue
+			case subscribed := <- r.reclaimListener:
+				r.reclaimChannels(subscribed)
+				continue
+			case statusListener := <- r.statusListener:
+				var channels = make([]HubStatusChannel, 0, len(r.channels))
+				for _, channel := range(r.channels) {
+					channels = append(channels, HubStatusChannel{ChannelName: channel.ChannelName})
+				}
+				statusListener <- channels
+				continue
+		}
 		var channel = r.channels[channelRequest.channelName]
+		var private = strings.HasPrefix(channelRequest.channelName, "private_")
+		if channel == nil && !private && len(r.channels) - r.privateChannels >= r.maxChannels {
+			l.Wf("channels process - channel %s not created, limit of %d channels reached", channelRequest.channelName, r.maxChannels);
+			channelRequest.resultListener <- HubRepositoryChannelFeeds{err: newHubError(http.StatusForbidden, "limit of %d channels reached", r.maxChannels)}
+			continue
+		}
 		if channel == nil {
 			l.If("channels process - add channel %s", channelRequest.channelName);
 			channel = new (Channel)
@@ -98,7 +217,7 @@ func (r *HubRepository) channelProcess() {
 			r.addCreatedChannel(channel)
 		}
 		l.If("channels process - served channel %s", channelRequest.channelName);
-		channelRequest.resultListener <- HubRepositoryChannelFeeds{newDataListener: r.newDataListener[channel.ChannelName], getDataListener: r.getDataListener[channel.ChannelName]}
+		channelRequest.resultListener <- HubRepositoryChannelFeeds{newDataListener: r.newDataListener[channel.ChannelName], getDataListener: r.getDataListener[channel.ChannelName], stopped: r.stopListener[channel.ChannelName]}
 	}
 	
 	l.I("channels process - end")
@@ -107,63 +226,162 @@ func (r *HubRepository) channelProcess() {
 /**
 * receive and feed data from a channel
 **/
-func (r *HubRepository) dataProcess(channelName string) {
+func (r *HubRepository) dataProcess(channel *Channel, feeds HubRepositoryChannelFeeds, stopListener chan bool) {
+	var channelName = channel.ChannelName
 	l.If("data process - %s - start", channelName)
+	defer l.If("data process - %s - stop", channelName)
 	for {
 		select {
 			// on new data
-			case newData := <- r.newDataListener[channelName]: 
+			case newData := <- feeds.newDataListener: 
 				l.If("data process - %s - new data: %s ", channelName, newData.ToJson())
-				var channel = r.channels[newData.ChannelName]
-				if channel == nil {
-					channel = new (Channel)
-					channel.ChannelName = newData.ChannelName
-					channel.DataVersion = 0 
-					channel.Data = "" 
-					r.channels[newData.ChannelName] = channel
+				if newData.Command == channelReclaim {
+					var empty = channel.DataVersion == 0 && channel.Data == "" && len(channel.Updates) == 0 && channel.DataTime.IsZero() && channel.Options == (ChannelOptions{})
+					if empty {
+						newData.responseListener <- ChannelDataOperation{operation: channelReclaim}
+						return
+					}
+					newData.responseListener <- ChannelDataOperation{}
+					continue
+				} else if newData.Command == DataConfigure {
+					newData.configure(&channel.Options)
+					newData.responseListener <- ChannelDataOperation{operation: DataConfigure, channelData: ChannelData{ChannelName: channelName}, contentType: channel.Options.ContentType, options: channel.Options}
+				} else if newData.publisher != "" && !channel.Options.ClientPublish {
+					newData.responseListener <- ChannelDataOperation{err: newHubError(http.StatusForbidden, "publishing to channel %s is not allowed", channelName)}
+					continue
+				} else if channel.Options.Queue != "" {
+					// queue items are not stored in the channel, queues process delivers them
+					if newData.Command == DataClear {
+						newData.responseListener <- ChannelDataOperation{err: newHubError(http.StatusBadRequest, "queue channel %s can not be cleared", channelName)}
+					} else {
+						newData.responseListener <- ChannelDataOperation{operation: QueueItemCommand, channelData: ChannelData{ChannelName: channelName, Data: newData.Data, Publisher: newData.publisher}, contentType: channel.Options.ContentType, queue: channel.Options.Queue}
+					}
+					continue
+				} else {
+					var now = r.clock.Now()
+					channel.addNewData(newData, now)
+					if newData.Command == DataUpdate {
+						channel.applyRetention(r.channelRetention(), now)
+					}
 				}
-				channel.addNewData(DataOperation(newData.Command), newData.Data, newData.responseListener)
-				if !strings.HasPrefix("private", channel.ChannelName) {
+				if !strings.HasPrefix(channel.ChannelName, "private_") {
 					// persist data
 					var js, _ = json.Marshal(channel)
-					var err = ioutil.WriteFile("data/" + channel.ChannelName + ".json", js, 0644)
+					var err = ioutil.WriteFile(filepath.Join(r.dataDir, channel.ChannelName + ".json"), js, 0644)
 			    if err != nil { 
 			    	log.Panic(err) 
 			    }
 			   }
 		  // on data feed request
-		  case newRequest := <- r.getDataListener[channelName]:
+		  case newRequest := <- feeds.getDataListener:
 		  	l.If("data process - %s - get data", channelName)
-				var channel = r.channels[newRequest.channelName]
-				var result Channel
-				if channel == nil {
-					result = Channel{newRequest.channelName, 0, "", time.Now(), make([]ChannelData, 0)}
-				} else {
-					result = channel.Copy()
-				}
-				newRequest.responseReceiver <- result
+				newRequest.responseReceiver <- channel.Copy()
+			case <- stopListener:
+				return
 		}	 
 	}
-	l.If("data process - %s - stop", channelName)
 }
 
 /**
 * stores new data and informs sunscribers
 */
-func (h *Hub) AddNewDataToChannel(command string, channel string, data string) {
+func (h *Hub) AddNewDataToChannel(command string, channel string, data string) error {
+	if err := h.validateChannelData(channel, data); err != nil {
+		return err
+	}
+	return h.addNewDataToChannel(ChannelDataInputCommand{Command: command, ChannelName: channel, Data: data})
+}
+
+/**
+* stores data published by a client - channel must allow client publishing
+* data is stamped with publisher id of the subscriber, with echo false it is not sent back to the publisher
+*/
+func (h *Hub) PublishToChannel(command string, channel string, data string, publisherId string, echo bool) error {
+	if command != DataCreate && command != DataUpdate && command != DataClear {
+		return newHubError(http.StatusBadRequest, "invalid publish operation '%s'", command)
+	}
+	if err := h.validateChannelData(channel, data); err != nil {
+		return err
+	}
+	if strings.HasPrefix(channel, "private_") {
+		return newHubError(http.StatusForbidden, "publishing to private channels is not allowed")
+	}
+	return h.addNewDataToChannel(ChannelDataInputCommand{Command: command, ChannelName: channel, Data: data, publisher: publisherId, noEcho: !echo})
+}
+
+func (h *Hub) validateChannelData(channel string, data string) error {
 	if strings.Trim(channel, "") == "" {
-		return
+		return newHubError(http.StatusBadRequest, "channel not set")
+	}
+	if err := h.validateChannelName(channel); err != nil {
+		return err
 	}
-	// get channel (created if necessary)
+	return h.validateDataSize(data)
+}
+
+/**
+* changes channel options, channel is created if necessary
+* presence members follow presence option of the channel
+*/
+func (h *Hub) ConfigureChannel(channel string, configure func(options *ChannelOptions)) error {
+	if err := h.validateChannelName(channel); err != nil {
+		return err
+	}
+	operation, err := h.sendChannelData(ChannelDataInputCommand{Command: DataConfigure, ChannelName: channel, configure: configure})
+	if err != nil {
+		return err
+	}
+	h.requestSubscriber(HubSubscriberRequest{command: ConfigurePresence, channels: []string{channel}, presence: operation.options.Presence})
+	return nil
+}
+
+/**
+* feeds of channel data process, channel is created if necessary
+*/
+func (h *Hub) channelFeeds(channelName string) HubRepositoryChannelFeeds {
 	channelFeedsListener := make(chan HubRepositoryChannelFeeds)
-	h.repository.getChannelListener <- HubRepositoryChannelGetCommand{channelName: channel, resultListener: channelFeedsListener}
-	var channelFeeds = <- channelFeedsListener
-	close(channelFeedsListener)
-	// feed data to channel/repository
+	defer close(channelFeedsListener)
+	h.repository.getChannelListener <- HubRepositoryChannelGetCommand{channelName: channelName, resultListener: channelFeedsListener}
+	return <- channelFeedsListener
+}
+
+/**
+* passes command to channel data process and waits for its response
+* channel removed in the meantime is created again
+*/
+func (h *Hub) sendChannelData(newData ChannelDataInputCommand) (ChannelDataOperation, error) {
 	var responseListener = make(chan ChannelDataOperation)
-	channelFeeds.newDataListener <- ChannelDataInputCommand{Command: command, ChannelName: channel, Data: data, responseListener: responseListener}
-	var dataResponse = <- responseListener
+	newData.responseListener = responseListener
+	for {
+		var channelFeeds = h.channelFeeds(newData.ChannelName)
+		if channelFeeds.err != nil {
+			return ChannelDataOperation{}, channelFeeds.err
+		}
+		select {
+			case channelFeeds.newDataListener <- newData:
+				return <- responseListener, nil
+			case <- channelFeeds.stopped:
+		}
+	}
+}
+
+/**
+* stores data without checking name and size limits - for data produced by the hub itself
+*/
+func (h *Hub) addNewDataToChannel(newData ChannelDataInputCommand) error {
+	// feed data to channel/repository (created if necessary)
+	dataResponse, err := h.sendChannelData(newData)
+	if err != nil {
+		return err
+	}
+	if dataResponse.err != nil {
+		return dataResponse.err
+	}
+	if dataResponse.operation == QueueItemCommand {
+		var item = queueItem{data: dataResponse.channelData.Data, contentType: dataResponse.contentType, publisher: dataResponse.channelData.Publisher}
+		return h.queueProcess(queueProcessCommand{command: queueEnqueue, channelName: newData.ChannelName, dispatch: dataResponse.queue, item: item}).err
+	}
 	// send data to subscribers
 	h.subscriberFeedListener <- dataResponse
+	return nil
 }
-
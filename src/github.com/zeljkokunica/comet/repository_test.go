@@ -0,0 +1,67 @@
+package comet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelLimitReclaimsEmptyChannels(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.MaxChannels = 3
+	// status is refreshed only once, its cleanup may reclaim channels created below
+	config.Clock = newFakeClock()
+	var hub = NewHub(config)
+	if err := hub.AddNewDataToChannel(DataCreate, "kept", "data"); err != nil {
+		t.Fatal(err)
+	}
+	var limited = false
+	for created := 1; created <= 10 && !limited; created++ {
+		_, err := hub.getChannelData("empty" + string(rune('a' + created)), -1)
+		limited = err != nil
+	}
+	if !limited {
+		t.Fatalf("channel limit of %d not enforced", hub.repository.maxChannels)
+	}
+	// private channels do not count into limit
+	for i := 0; i < 5; i++ {
+		if response := hub.requestSubscriber(HubSubscriberRequest{command: Subscribe}); response.err != nil {
+			t.Fatalf("subscriber %d not created at channel limit: %s", i, response.err.Error())
+		}
+	}
+	hub.repository.reclaimListener <- map[string]bool{}
+	var deadline = time.Now().Add(2 * time.Second)
+	for {
+		if _, err := hub.getChannelData("new", -1); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("empty channels not reclaimed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := hub.getChannelData("kept", -1)
+	if err != nil || data.Data != "data" {
+		t.Errorf("channel with data not kept: %v %v", data, err)
+	}
+}
+
+func TestConfiguredDataLimits(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.MaxDataSize = 4
+	config.MaxChannelNameLength = 5
+	var hub = NewHub(config)
+	for _, check := range([]struct {
+		channel string
+		data string
+		code int
+	}{
+		{"short", "four", 0},
+		{"short", "fives", 413},
+		{"longer", "four", 400},
+	}) {
+		var err = hub.AddNewDataToChannel(DataCreate, check.channel, check.data)
+		if hubErr, ok := err.(*HubError); check.code == 0 && err != nil || check.code != 0 && (!ok || hubErr.Code != check.code) {
+			t.Errorf("publishing %s to %s returned %v, expected code %d", check.data, check.channel, err, check.code)
+		}
+	}
+}
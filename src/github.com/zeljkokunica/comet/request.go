@@ -0,0 +1,212 @@
+package comet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* request/reply commands
+* request is sent to subscribers of service channel (workers), reply and error only to requester's private channel
+*/
+const (
+	RequestCommand = "request"
+	ReplyCommand = "reply"
+	ReplyErrorCommand = "error"
+)
+
+const (
+	requestRegister = 1
+	requestReply = 2
+)
+
+/**
+* request waiting for reply
+*/
+type pendingRequest struct {
+	correlationId string
+	subscriberId string
+	service string
+	deadline time.Time
+}
+
+type requestProcessCommand struct {
+	command int
+	request pendingRequest
+	// reply data, or error when errorCode is set
+	data string
+	errorCode int
+	// subscriber sending reply, must be subscribed to service of the request
+	replierId string
+	responseListener chan error
+}
+
+/**
+* tracks pending requests, delivers replies and timeout errors
+*/
+func (h *Hub) requestsProcess() {
+	l.I("requests process - start")
+	defer l.I("requests process - end")
+	var requests = make(map[string]pendingRequest)
+	var timeoutCheck = h.config.Clock.After(h.config.ExpiryCheckPeriod)
+	for {
+		select {
+			case command := <- h.requestListener:
+				switch command.command {
+					case requestRegister:
+						if _, found := requests[command.request.correlationId]; found {
+							command.responseListener <- newHubError(http.StatusConflict, "request %s is already waiting for reply", command.request.correlationId)
+						} else if len(requests) >= maxPendingRequests {
+							command.responseListener <- newHubError(http.StatusServiceUnavailable, "too many pending requests")
+						} else {
+							requests[command.request.correlationId] = command.request
+							command.responseListener <- nil
+						}
+					case requestReply:
+						request, found := requests[command.request.correlationId]
+						if !found {
+							command.responseListener <- newHubError(http.StatusNotFound, "no request %s is waiting for reply", command.request.correlationId)
+							continue
+						}
+						// correlation id is seen by every worker, only they can reply
+						if !h.subscribedToChannel(command.replierId, request.service) {
+							command.responseListener <- newHubError(http.StatusForbidden, "replier is not subscribed to service %s", request.service)
+							continue
+						}
+						delete(requests, request.correlationId)
+						command.responseListener <- nil
+						if command.errorCode != 0 {
+							h.sendReplyError(request, command.errorCode, command.data)
+						} else {
+							h.sendToChannel(ReplyCommand, privateChannelName(request.subscriberId), command.data, request.correlationId, "")
+						}
+				}
+			case now := <- timeoutCheck:
+				timeoutCheck = h.config.Clock.After(h.config.ExpiryCheckPeriod)
+				for correlationId, request := range(requests) {
+					if now.After(request.deadline) {
+						l.Wf("requests process - request %s to %s timed out", correlationId, request.service)
+						delete(requests, correlationId)
+						h.sendReplyError(request, http.StatusGatewayTimeout, "request to " + request.service + " timed out")
+					}
+				}
+		}
+	}
+}
+
+func (h *Hub) sendReplyError(request pendingRequest, code int, message string) {
+	data, _ := json.Marshal(ErrorResponse{Code: code, Error: message})
+	h.sendToChannel(ReplyErrorCommand, privateChannelName(request.subscriberId), string(data), request.correlationId, "")
+}
+
+/**
+* sends transient command to subscribers of channel - it is not stored in the channel and has no version
+*/
+func (h *Hub) sendToChannel(command string, channel string, data string, correlationId string, publisher string) {
+	h.subscriberFeedListener <- ChannelDataOperation{operation: DataOperation(command), channelData: ChannelData{ChannelName: channel, Data: data, Publisher: publisher}, correlationId: correlationId}
+}
+
+func privateChannelName(subscriberId string) string {
+	return fmt.Sprintf("private_%s", subscriberId)
+}
+
+/**
+* sends request to service channel, reply is delivered to requester's private channel
+* parameters: id - requester, service, data, correlationId (generated when not set), timeout in milliseconds
+*/
+func (h *Hub) onRequestRequest(m DataMediator) {
+	var request = pendingRequest{correlationId: m.ReadParameter("correlationId"), subscriberId: m.ReadParameter("id"), service: m.ReadParameter("service")}
+	if request.subscriberId == "" {
+		m.WriteError(http.StatusBadRequest, "requester id not set")
+		return
+	}
+	if err := h.validateChannelName(request.service); err != nil {
+		writeHubError(m, err)
+		return
+	}
+	if strings.HasPrefix(request.service, "private_") {
+		m.WriteError(http.StatusForbidden, "requests to private channels are not allowed")
+		return
+	}
+	if request.correlationId == "" {
+		request.correlationId, _ = newUUID()
+	} else if len(request.correlationId) > h.config.MaxChannelNameLength {
+		m.WriteError(http.StatusBadRequest, fmt.Sprintf("correlationId longer than %d characters", h.config.MaxChannelNameLength))
+		return
+	}
+	var timeout = h.config.RequestTimeout
+	if timeoutParam := m.ReadParameter("timeout"); timeoutParam != "" {
+		milliseconds, err := strconv.ParseInt(timeoutParam, 10, 64)
+		if err != nil || milliseconds <= 0 {
+			m.WriteError(http.StatusBadRequest, "invalid timeout")
+			return
+		}
+		timeout = time.Duration(milliseconds) * time.Millisecond
+		if timeout > h.config.MaxRequestTimeout {
+			timeout = h.config.MaxRequestTimeout
+		}
+	}
+	request.deadline = h.config.Clock.Now().Add(timeout)
+	data, err := readData(m)
+	if err == nil {
+		err = h.validateDataSize(data)
+	}
+	if err == nil {
+		err = h.requestProcess(requestProcessCommand{command: requestRegister, request: request})
+	}
+	if err != nil {
+		writeHubError(m, err)
+		return
+	}
+	// workers reply by correlation id, requester's subscriber id is not sent to them
+	h.sendToChannel(RequestCommand, request.service, data, request.correlationId, "")
+	m.WriteResponse(map[string]interface{}{"command": RequestCommand, "service": request.service, "correlationId": request.correlationId}, "json")
+}
+
+/**
+* worker's reply to a request
+* parameters: id - worker subscribed to service channel, correlationId, data,
+* or error with optional code (502 by default) when request failed
+*/
+func (h *Hub) onReplyRequest(m DataMediator) {
+	var command = requestProcessCommand{command: requestReply, request: pendingRequest{correlationId: m.ReadParameter("correlationId")}, replierId: m.ReadParameter("id")}
+	if command.replierId == "" {
+		m.WriteError(http.StatusBadRequest, "replier id not set")
+		return
+	}
+	if errorMessage := m.ReadParameter("error"); errorMessage != "" {
+		command.data = errorMessage
+		command.errorCode = http.StatusBadGateway
+		if code, err := strconv.Atoi(m.ReadParameter("code")); err == nil && code > 0 {
+			command.errorCode = code
+		}
+	} else {
+		data, err := readData(m)
+		if err == nil {
+			err = h.validateDataSize(data)
+		}
+		if err != nil {
+			writeHubError(m, err)
+			return
+		}
+		command.data = data
+	}
+	if err := h.requestProcess(command); err != nil {
+		writeHubError(m, err)
+		return
+	}
+	m.WriteResponse(map[string]interface{}{"command": ReplyCommand, "correlationId": command.request.correlationId}, "json")
+}
+
+func (h *Hub) requestProcess(command requestProcessCommand) error {
+	var responseListener = make(chan error)
+	defer close(responseListener)
+	command.responseListener = responseListener
+	h.requestListener <- command
+	return <- responseListener
+}
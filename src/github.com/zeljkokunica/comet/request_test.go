@@ -0,0 +1,95 @@
+package comet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+* reads feed of subscriber until command with correlation id arrives, snapshots come first
+*/
+func receiveTestCorrelated(t *testing.T, subscriber Subscriber, channel string, correlationId string) SubscriberResponseCommand {
+	var deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, command := range(receiveTestFeed(t, subscriber, channel)) {
+			if command.CorrelationId == correlationId {
+				return command
+			}
+		}
+	}
+	t.Fatalf("subscriber %s did not receive %s on %s", subscriber.id, correlationId, channel)
+	return SubscriberResponseCommand{}
+}
+
+/**
+* workers receive request with correlation id, requester's subscriber id is not sent to them
+*/
+func TestRequestHidesRequester(t *testing.T) {
+	var hub = newTestHub(t)
+	var server = httptest.NewServer(hub)
+	defer server.Close()
+	var worker = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"service"}, options: SubscriptionOptions{Mode: SubscriptionDeltas}}).subscriber
+	var requester = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	response, err := http.Get(server.URL + "/request?service=service&data=ping&correlationId=c1&id=" + requester.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	var request = receiveTestCorrelated(t, worker, "service", "c1")
+	if request.Command != RequestCommand {
+		t.Fatalf("worker received %v, expected request c1", request)
+	}
+	if request.Publisher != "" || strings.Contains(request.Data, requester.id) {
+		t.Errorf("request %v carries requester id", request)
+	}
+	response, err = http.Get(server.URL + "/reply?correlationId=c1&data=pong&id=" + worker.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	// reply is fed to requester after reply request returns
+	if reply := receiveTestCorrelated(t, requester, privateChannelName(requester.id), "c1"); reply.Command != ReplyCommand || reply.Data != "pong" {
+		t.Errorf("requester received %v, expected reply pong", reply)
+	}
+}
+
+/**
+* correlation id alone does not allow replying - replier must be subscribed to the service channel
+*/
+func TestReplyOnlyFromServiceSubscribers(t *testing.T) {
+	var hub = newTestHub(t)
+	var server = httptest.NewServer(hub)
+	defer server.Close()
+	var worker = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"service"}}).subscriber
+	var requester = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	var outsider = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	response, err := http.Get(server.URL + "/request?service=service&data=ping&correlationId=c2&id=" + requester.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	for _, check := range([]struct {
+		query string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"&id=" + outsider.id, http.StatusForbidden},
+		{"&id=unknown", http.StatusForbidden},
+		{"&id=" + worker.id, http.StatusOK},
+	}) {
+		response, err := http.Get(server.URL + "/reply?correlationId=c2&data=pong" + check.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != check.status {
+			t.Errorf("reply%s returned %d, expected %d", check.query, response.StatusCode, check.status)
+		}
+	}
+	if reply := receiveTestCorrelated(t, requester, privateChannelName(requester.id), "c2"); reply.Data != "pong" {
+		t.Errorf("requester received %v, expected reply of worker", reply)
+	}
+}
@@ -1,14 +1,21 @@
 package comet
 
 import (
+	"compress/gzip"
+	"encoding/base64"
+	"io"
 	"github.com/zeljkokunica/l"
 	"time"
 	"fmt"
 	"net/http"
+	"net"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"io/ioutil"
 	"encoding/json"
-	"code.google.com/p/go.net/websocket"
 )
 /**
 * parse request, and return response
@@ -23,11 +30,71 @@ type DataMediator interface {
 	* writes response
 	*/
 	WriteResponse(response interface{}, contentType string)
+
+	/**
+	* writes error response - http status code and message
+	*/
+	WriteError(code int, message string)
+
+	/**
+	* address of the client (without port)
+	*/
+	RemoteAddr() string
+}
+
+/**
+* mediator able to keep response open and stream data to client (http only)
+*/
+type StreamDataMediator interface {
+	DataMediator
+
+	/**
+	* read request header
+	*/
+	ReadHeader(headerName string) string
+
+	/**
+	* writes headers and starts streaming response
+	*/
+	StartStream(contentType string)
+
+	/**
+	* writes data and flushes it to client
+	*/
+	WriteStream(data []byte) error
+
+	/**
+	* closed when client closes connection
+	*/
+	Done() <-chan struct{}
+}
+
+/**
+* error sent to client when request is rejected
+*/
+type ErrorResponse struct {
+	Code int `json:"code"`
+	Error string `json:"error"`
 }
 
 type HttpDataMediator struct {
 	w http.ResponseWriter 
 	r *http.Request
+	// jsonp function name - response is written as javascript calling it
+	callback string
+	// encoding of json responses
+	codec Codec
+	// limit of request body, MaxDataSize of hub config
+	maxDataSize int
+}
+
+// commands that can be requested with jsonp callback parameter
+var jsonpCommands = map[string]bool{"subscribe": true, "data": true, "addchannels": true, "removechannels": true, "resync": true, "presence": true, "request": true}
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+var maxJsonpCallbackLength = 128
+
+func validJsonpCallback(callback string) bool {
+	return len(callback) <= maxJsonpCallbackLength && jsonpCallbackPattern.MatchString(callback)
 }
 
 func (m *HttpDataMediator) ReadParameter(parameterName string) string {
@@ -35,15 +102,164 @@ func (m *HttpDataMediator) ReadParameter(parameterName string) string {
 }
 
 func (m *HttpDataMediator) WriteResponse(response interface{}, contentType string)  {
-	if (contentType == "json") {
-		jsonData, _ := json.Marshal(response)
-		fmt.Fprintf(m.w, "%s", jsonData)
+	if m.callback != "" {
+		m.writeJsonp(response)
+	} else if (contentType == "json") {
+		data, err := m.codec.Marshal(response)
+		if err != nil {
+			l.Ef("error encoding response as %s: %s", m.codec.Name(), err.Error())
+		}
+		m.w.Header().Set("Content-Type", m.codec.ContentType())
+		m.writeCompressed(data)
 	} else {
 		fmt.Fprintf(m.w, "%s", response)
 	}
 }
 
+/**
+* writes data gzipped if client accepts gzip and data is not smaller than compressionThreshold
+*/
+func (m *HttpDataMediator) writeCompressed(data []byte) {
+	m.w.Header().Add("Vary", "Accept-Encoding")
+	if len(data) < compressionThreshold || !acceptsGzip(m.r) {
+		m.w.Write(data)
+		return
+	}
+	m.w.Header().Set("Content-Encoding", "gzip")
+	var writer = gzip.NewWriter(m.w)
+	writer.Write(data)
+	writer.Close()
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range(strings.Split(r.Header.Get("Accept-Encoding"), ",")) {
+		var parts = strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, parameter := range(parts[1:]) {
+			parameter = strings.TrimSpace(parameter)
+			if strings.HasPrefix(parameter, "q=") {
+				quality, err := strconv.ParseFloat(parameter[2:], 64)
+				return err == nil && quality > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+/**
+* writes response as javascript calling callback with response json
+* leading comment prevents content sniffing attacks (rosetta flash)
+*/
+func (m *HttpDataMediator) writeJsonp(response interface{}) {
+	jsonData, _ := json.Marshal(response)
+	m.w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	m.w.Header().Set("X-Content-Type-Options", "nosniff")
+	m.writeCompressed([]byte(fmt.Sprintf("/**/%s(%s);", m.callback, jsonData)))
+}
+
+func (m *HttpDataMediator) WriteError(code int, message string) {
+	if m.callback != "" {
+		// script is not executed for error status codes - error is passed to callback
+		m.writeJsonp(ErrorResponse{Code: code, Error: message})
+		return
+	}
+	data, _ := m.codec.Marshal(ErrorResponse{Code: code, Error: message})
+	m.w.Header().Set("Content-Type", m.codec.ContentType())
+	m.w.WriteHeader(code)
+	m.w.Write(data)
+}
+
+func (m *HttpDataMediator) RemoteAddr() string {
+	return remoteHost(m.r.RemoteAddr)
+}
+
+/**
+* request body when it is not a form (raw data publish), limited to maxDataSize of mediator
+*/
+func (m *HttpDataMediator) readBody() (string, bool, error) {
+	if m.r.Body == nil || (m.r.Method != "POST" && m.r.Method != "PUT") {
+		return "", false, nil
+	}
+	var mediaType = strings.ToLower(strings.TrimSpace(strings.Split(m.r.Header.Get("Content-Type"), ";")[0]))
+	if mediaType == "" || mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		return "", false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(m.r.Body, int64(m.maxDataSize) + 1))
+	if err != nil {
+		return "", true, newHubError(http.StatusBadRequest, "error reading request body")
+	}
+	return string(body), true, nil
+}
+
+func (m *HttpDataMediator) ReadHeader(headerName string) string {
+	return m.r.Header.Get(headerName)
+}
+
+func (m *HttpDataMediator) StartStream(contentType string) {
+	m.w.Header().Set("Content-Type", contentType)
+	m.w.Header().Set("Cache-Control", "no-cache")
+	// disable proxy buffering (nginx)
+	m.w.Header().Set("X-Accel-Buffering", "no")
+	m.w.WriteHeader(http.StatusOK)
+	if flusher, ok := m.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (m *HttpDataMediator) WriteStream(data []byte) error {
+	if _, err := m.w.Write(data); err != nil {
+		return err
+	}
+	if flusher, ok := m.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (m *HttpDataMediator) Done() <-chan struct{} {
+	return m.r.Context().Done()
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+/**
+* takes tokens from address, subscriber and channel rate limits
+* returns false and writes 429 response if any of the limits is exceeded
+*/
+func (h *Hub) allowRequest(command string, m DataMediator) bool {
+	if !h.addressLimiter.Allow(m.RemoteAddr()) {
+		l.Wf("rate limit - address %s exceeded on %s", m.RemoteAddr(), command)
+		m.WriteError(http.StatusTooManyRequests, "rate limit exceeded for address")
+		return false
+	}
+	if id := m.ReadParameter("id"); id != "" && !h.subscriberLimiter.Allow(id) {
+		l.Wf("rate limit - subscriber %s exceeded on %s", id, command)
+		m.WriteError(http.StatusTooManyRequests, "rate limit exceeded for subscriber")
+		return false
+	}
+	if command == "create" || command == "update" || command == "clear" {
+		if channel := m.ReadParameter("channel"); !h.channelLimiter.Allow(channel) {
+			l.Wf("rate limit - channel %s exceeded on %s", channel, command)
+			m.WriteError(http.StatusTooManyRequests, "rate limit exceeded for channel")
+			return false
+		}
+	}
+	return true
+}
+
 func (h *Hub) route(command string, mediator DataMediator) {
+	if !h.allowRequest(command, mediator) || !h.authorize(h.commandAccessLevel(command), mediator) {
+		return
+	}
 	if command == "ping" {
 		mediator.WriteResponse("pong", "plain");		
 	} else if command == "subscribe" {
@@ -52,58 +268,151 @@ func (h *Hub) route(command string, mediator DataMediator) {
 		h.onAddChannelsRequest(mediator)
 	} else if command == "removechannels" {
 		h.onRemoveChannelsRequest(mediator)
+	} else if command == "resync" {
+		h.onResyncRequest(mediator)
+	} else if command == "presence" {
+		h.onPresenceRequest(mediator)
+	} else if command == "request" {
+		h.onRequestRequest(mediator)
+	} else if command == "reply" {
+		h.onReplyRequest(mediator)
+	} else if command == "ack" {
+		h.onAckRequest(mediator, queueAck)
+	} else if command == "nack" {
+		h.onAckRequest(mediator, queueNack)
 	} else if command == "data" {
 		h.onGetDataRequest(mediator)
+	} else if command == "events" {
+		h.onEventsRequest(mediator)
 	} else if command == "create" {
 		h.onCreateDataRequest(mediator)
 	} else if command == "update" {
 		h.onUpdateDataRequest(mediator)
 	} else if command == "clear" {
 		h.onClearDataRequest(mediator)
+	} else if command == "configure" {
+		h.onConfigureRequest(mediator)
+	} else if command == "scheduled" {
+		h.onScheduledRequest(mediator)
+	} else if command == "cancelscheduled" {
+		h.onCancelScheduledRequest(mediator)
+	} else if command == "reload" {
+		h.onReloadRequest(mediator)
+	} else if route, path := h.backendRoutes.match(command); route != nil {
+		h.onBackendRequest(route, path, mediator)
 	} else {
 		h.onServeFileRequest(mediator, command)
 	}
 }
 
+/**
+* subscription options from mode, identity, metadata, filter and fields parameters
+*/
+func (h *Hub) readSubscriptionOptions(m DataMediator) (SubscriptionOptions, error) {
+	var options = SubscriptionOptions{Mode: m.ReadParameter("mode"), Identity: m.ReadParameter("identity"), Metadata: m.ReadParameter("metadata"), Filter: m.ReadParameter("filter"), Fields: m.ReadParameter("fields")}
+	switch options.Mode {
+		case "":
+			options.Mode = SubscriptionSnapshot
+		case SubscriptionSnapshot, SubscriptionDeltas, SubscriptionLatest:
+		default:
+			return SubscriptionOptions{}, newHubError(http.StatusBadRequest, "invalid subscription mode '%s' - allowed are %s, %s and %s", options.Mode, SubscriptionSnapshot, SubscriptionDeltas, SubscriptionLatest)
+	}
+	if len(options.Identity) > h.config.MaxChannelNameLength {
+		return SubscriptionOptions{}, newHubError(http.StatusBadRequest, "identity longer than %d characters", h.config.MaxChannelNameLength)
+	}
+	if err := h.validateDataSize(options.Metadata); err != nil {
+		return SubscriptionOptions{}, err
+	}
+	filter, err := parseFilter(options.Filter)
+	if err != nil {
+		return SubscriptionOptions{}, err
+	}
+	options.filter = filter
+	projection, err := parseProjection(options.Fields)
+	if err != nil {
+		return SubscriptionOptions{}, err
+	}
+	options.projection = projection
+	return options, nil
+}
+
 func (h *Hub) onSubscribeRequest(m DataMediator) {
 	var channels = strings.Split(m.ReadParameter("channels"), ",")
-	var responseListener = make(chan Subscriber)
-	defer close(responseListener)
-	h.subscriberCommandListener <- HubSubscriberRequest{command: Subscribe, channels: channels, responseListener: responseListener}
-	var subscriber = <- responseListener
-	m.WriteResponse(map[string]interface{}{"command": "subscribe", "subscriberId": subscriber.id}, "json");
+	options, err := h.readSubscriptionOptions(m)
+	if err != nil {
+		writeHubError(m, err)
+		return
+	}
+	var response = h.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: channels, options: options})
+	if response.err != nil {
+		writeHubError(m, response.err)
+		return
+	}
+	m.WriteResponse(map[string]interface{}{"command": "subscribe", "subscriberId": response.subscriber.id}, "json");
 }
 
 func (h *Hub) onAddChannelsRequest(m DataMediator) {
 	var channels = strings.Split(m.ReadParameter("channels"), ",")
 	var id = m.ReadParameter("id")
-	var responseListener = make(chan Subscriber)
-	defer close(responseListener)
-	h.subscriberCommandListener <- HubSubscriberRequest{command: SubscribeToChannels, channels: channels, subscriberId: id, responseListener: responseListener}
-	var subscriber = <- responseListener
-	m.WriteResponse(subscriber.id, "plain");
+	options, err := h.readSubscriptionOptions(m)
+	if err != nil {
+		writeHubError(m, err)
+		return
+	}
+	var response = h.requestSubscriber(HubSubscriberRequest{command: SubscribeToChannels, channels: channels, subscriberId: id, options: options})
+	if response.err != nil {
+		writeHubError(m, response.err)
+		return
+	}
+	m.WriteResponse(response.subscriber.id, "plain");
 }
 
 func (h *Hub) onRemoveChannelsRequest(m DataMediator) {
 	var channels = strings.Split(m.ReadParameter("channels"), ",")
 	var id = m.ReadParameter("id")
-	var responseListener = make(chan Subscriber)
-	defer close(responseListener)
-	h.subscriberCommandListener <- HubSubscriberRequest{command: UnsubscribeFromChannels, channels: channels, subscriberId: id, responseListener: responseListener}
-	var subscriber = <- responseListener
-	m.WriteResponse(subscriber.id, "plain");
+	var response = h.requestSubscriber(HubSubscriberRequest{command: UnsubscribeFromChannels, channels: channels, subscriberId: id})
+	m.WriteResponse(response.subscriber.id, "plain");
+}
+
+/**
+* client detected skipped versions - fresh data of channels is sent as resync command
+*/
+func (h *Hub) onResyncRequest(m DataMediator) {
+	var channels = strings.Split(m.ReadParameter("channels"), ",")
+	var id = m.ReadParameter("id")
+	var response = h.requestSubscriber(HubSubscriberRequest{command: ResyncChannels, channels: channels, subscriberId: id})
+	m.WriteResponse(response.subscriber.id, "plain");
+}
+
+/**
+* current members of channel with presence enabled
+*/
+func (h *Hub) onPresenceRequest(m DataMediator) {
+	var channel = m.ReadParameter("channel")
+	if err := h.validateChannelName(channel); err != nil {
+		writeHubError(m, err)
+		return
+	}
+	var response = h.requestSubscriber(HubSubscriberRequest{command: GetPresence, channels: []string{channel}})
+	m.WriteResponse(map[string]interface{}{"channel": channel, "members": response.members}, "json")
 }
 
 func (h *Hub) onGetDataRequest(m DataMediator) {
 	var id = m.ReadParameter("id")
-	var subscriber = h.subscribers[id]
+	// jsonp response is a single script, stream lines could not be wrapped in callback
+	if httpMediator, ok := m.(*HttpDataMediator); ok && httpMediator.callback != "" && m.ReadParameter("stream") == "true" {
+		m.WriteError(http.StatusBadRequest, "callback is not supported with stream")
+		return
+	}
+	subscriber, found := h.touchSubscriber(id)
 	// subscriber not found
-	if (subscriber == nil) {
+	if !found {
 		var response = SubscriberResponse{Status: -1}
 		m.WriteResponse(response, "json");
+	} else if stream, ok := m.(StreamDataMediator); ok && m.ReadParameter("stream") == "true" {
+		h.streamData(stream, &subscriber)
 	} else {
-		subscriber.lastRequest = time.Now().Unix()
-		timeout := time.After(30 * time.Second)
+		timeout := h.config.Clock.After(h.config.LongPollTimeout)
 		select {
 			case command := <- subscriber.feedListener:
 				var response SubscriberResponse
@@ -120,27 +429,123 @@ func (h *Hub) onGetDataRequest(m DataMediator) {
 	}
 }
 
+/**
+* data parameter, base64 decoded when encoding=base64, or raw http request body
+*/
+func readData(m DataMediator) (string, error) {
+	if httpMediator, ok := m.(*HttpDataMediator); ok {
+		if data, found, err := httpMediator.readBody(); found {
+			return data, err
+		}
+	}
+	var data = m.ReadParameter("data")
+	if m.ReadParameter("encoding") == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", newHubError(http.StatusBadRequest, "invalid base64 data")
+		}
+		return string(decoded), nil
+	}
+	return data, nil
+}
+
+/**
+* publishAt or delay parameter schedules create, update and clear - scheduled publish is the response
+*/
 func (h *Hub) onCreateDataRequest(m DataMediator) {
 	var channel = m.ReadParameter("channel")
-	var dataParam = m.ReadParameter("data")
-	h.AddNewDataToChannel("create", channel, dataParam)
+	var dataParam, err = readData(m)
+	if err == nil && h.scheduleDataRequest(m, DataCreate, dataParam) {
+		return
+	}
+	if err == nil && m.ReadParameter("contentType") != "" {
+		// create can declare channel content type
+		var contentType = m.ReadParameter("contentType")
+		err = h.ConfigureChannel(channel, func(options *ChannelOptions) { options.ContentType = contentType })
+	}
+	if err == nil {
+		err = h.AddNewDataToChannel("create", channel, dataParam)
+	}
+	if err != nil {
+		writeHubError(m, err)
+	}
 }
 
 func (h *Hub) onUpdateDataRequest(m DataMediator) {
 	var channel = m.ReadParameter("channel")
-	var dataParam = m.ReadParameter("data")
-	h.AddNewDataToChannel("update", channel, dataParam)
+	var dataParam, err = readData(m)
+	if err == nil && h.scheduleDataRequest(m, DataUpdate, dataParam) {
+		return
+	}
+	if err == nil {
+		err = h.AddNewDataToChannel("update", channel, dataParam)
+	}
+	if err != nil {
+		writeHubError(m, err)
+	}
 }
 
 func (h *Hub) onClearDataRequest(m DataMediator) {
 	var channel = m.ReadParameter("channel")
-	h.AddNewDataToChannel("clear", channel, "")
+	if h.scheduleDataRequest(m, DataClear, "") {
+		return
+	}
+	if err := h.AddNewDataToChannel("clear", channel, ""); err != nil {
+		writeHubError(m, err)
+	}
+}
+
+/**
+* changes channel options - only parameters that are set are changed
+* parameters: channel, contentType, presence, clientPublish, queue (roundrobin, leastloaded or off)
+*/
+func (h *Hub) onConfigureRequest(m DataMediator) {
+	var channel = m.ReadParameter("channel")
+	var contentType = m.ReadParameter("contentType")
+	var presence = m.ReadParameter("presence")
+	var clientPublish = m.ReadParameter("clientPublish")
+	var queue = m.ReadParameter("queue")
+	if queue != "" && queue != QueueRoundRobin && queue != QueueLeastLoaded && queue != QueueOff {
+		m.WriteError(http.StatusBadRequest, "queue must be roundrobin, leastloaded or off")
+		return
+	}
+	for name, value := range(map[string]string{"presence": presence, "clientPublish": clientPublish}) {
+		if _, err := strconv.ParseBool(value); value != "" && err != nil {
+			m.WriteError(http.StatusBadRequest, name + " must be true or false")
+			return
+		}
+	}
+	var options ChannelOptions
+	var err = h.ConfigureChannel(channel, func(channelOptions *ChannelOptions) {
+		if contentType != "" {
+			channelOptions.ContentType = contentType
+		}
+		if presence != "" {
+			channelOptions.Presence, _ = strconv.ParseBool(presence)
+		}
+		if clientPublish != "" {
+			channelOptions.ClientPublish, _ = strconv.ParseBool(clientPublish)
+		}
+		if queue == QueueOff {
+			channelOptions.Queue = ""
+		} else if queue != "" {
+			channelOptions.Queue = queue
+		}
+		options = *channelOptions
+	})
+	if err != nil {
+		writeHubError(m, err)
+		return
+	}
+	m.WriteResponse(options, "json")
 }
 
 func (h *Hub) onServeFileRequest(m DataMediator, file string) {
-	b, err := ioutil.ReadFile("web/" + file)
+	// cleaned as absolute path, so file can not point outside of web root
+	var filePath = filepath.Join(h.config.WebRoot, filepath.FromSlash(path.Clean("/" + file)))
+	b, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		l.Wf("file not found %s", "web/" + file)
+		l.Wf("file not found %s", filePath)
 	}
 	if err == nil {
 		l.Df("found file %s", file)
@@ -154,25 +559,61 @@ func (h *Hub) onServeFileRequest(m DataMediator, file string) {
 func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if x := recover(); x != nil {
-    	l.Ef("request %s caused error from %s {%s}: %v", r.URL.Path, r.RemoteAddr, r.Form.Encode(), x)
+    	l.Ef("request %s caused error from %s {%s}: %v", r.URL.Path, r.RemoteAddr, redactedForm(r.Form).Encode(), x)
     }
 	}() 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if origin := h.allowedOrigin(r.Header.Get("Origin")); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+	}
 	parts := strings.Split(r.URL.Path, "/")
 	command := parts[1]
+	if route, _ := h.backendRoutes.match(strings.Trim(r.URL.Path, "/")); route != nil {
+		command = strings.Trim(r.URL.Path, "/")
+	}
 	r.ParseForm()
 	startTime := time.Now()
-	l.If("http serving request %s from %s {%s}", r.URL.Path, r.RemoteAddr, r.Form.Encode())
-	mediator := HttpDataMediator{w: w, r: r}
+	l.If("http serving request %s from %s {%s}", r.URL.Path, r.RemoteAddr, redactedForm(r.Form).Encode())
+	mediator := HttpDataMediator{w: w, r: r, codec: negotiateCodec(r.FormValue("format"), r.Header.Get("Accept")), maxDataSize: h.config.MaxDataSize}
+	if callback := r.FormValue("callback"); callback != "" && jsonpCommands[command] {
+		if !validJsonpCallback(callback) {
+			mediator.WriteError(http.StatusBadRequest, "invalid callback")
+			return
+		}
+		if !h.allowedJsonpOrigin(r) {
+			mediator.WriteError(http.StatusForbidden, "callback is not allowed from this origin")
+			return
+		}
+		mediator.callback = callback
+		mediator.codec = JsonCodec
+	}
 	h.route(command, &mediator);	
 	delay := float64(time.Now().Sub(startTime).Nanoseconds()) / 1000000.0
-	l.If("http Served request %s from %s {%s} took %f ms", r.URL.Path, r.RemoteAddr, r.Form.Encode(), delay)
+	l.If("http Served request %s from %s {%s} took %f ms", r.URL.Path, r.RemoteAddr, redactedForm(r.Form).Encode(), delay)
 }
 /**
 * Websocket handler 
 */
-func (h *Hub) ServeWebsocket(ws *websocket.Conn) {
+func (h *Hub) ServeWebsocket(w http.ResponseWriter, r *http.Request) {
+	// browsers send origin, other clients are not restricted
+	if origin := r.Header.Get("Origin"); origin != "" && h.allowedOrigin(origin) == "" {
+		l.Wf("WebSocket from %s refused - origin %s not allowed", r.RemoteAddr, origin)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	ws, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.Wf("WebSocket upgrade from %s failed: %s", r.RemoteAddr, err.Error())
+		return
+	}
 	l.W("WebSocket connection")
-	handler := WebSocketHandler{ws: ws, send: make(chan WebSocketResponse, 255), hub: h, closeListener: make(chan bool)}
-  handler.reader()
+	var codec = codecSubprotocols[ws.Subprotocol()]
+	if codec == nil {
+		codec = negotiateCodec(r.FormValue("format"), "")
+	}
+	var handler = newWebSocketHandler(h, ws, remoteHost(r.RemoteAddr), codec)
+	handler.key = requestKey(&HttpDataMediator{w: w, r: r})
+	handler.serve()
 }
@@ -0,0 +1,107 @@
+package comet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/**
+* serves request by hub without network, header may be nil
+*/
+func requestTestHub(hub *Hub, target string, header http.Header) *httptest.ResponseRecorder {
+	var request = httptest.NewRequest("GET", target, nil)
+	for name, values := range(header) {
+		request.Header[name] = values
+	}
+	var recorder = httptest.NewRecorder()
+	hub.ServeHTTP(recorder, request)
+	return recorder
+}
+
+/**
+* callback is written into javascript response - only dotted identifiers are accepted
+*/
+func TestJsonpCallbackValidation(t *testing.T) {
+	var hub = newTestHub(t)
+	for _, callback := range([]string{"alert(1)//", "x;alert(1)", "cb</script>", "1cb", "app..cb", strings.Repeat("a", 129)}) {
+		var recorder = requestTestHub(hub, "/subscribe?channels=news&callback=" + url.QueryEscape(callback), nil)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("callback %q returned %d, expected 400", callback, recorder.Code)
+		}
+		if strings.Contains(recorder.Header().Get("Content-Type"), "javascript") || strings.Contains(recorder.Body.String(), callback) {
+			t.Errorf("callback %q written to response %s", callback, recorder.Body.String())
+		}
+	}
+	for _, callback := range([]string{"app.onData", "$cb_1", strings.Repeat("a", 128)}) {
+		var recorder = requestTestHub(hub, "/subscribe?channels=news&callback=" + callback, nil)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("callback %q returned %d, expected 200", callback, recorder.Code)
+			continue
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/javascript") {
+			t.Errorf("callback %q content type %s", callback, contentType)
+		}
+		if recorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("callback %q response may be sniffed", callback)
+		}
+		var body = recorder.Body.String()
+		if !strings.HasPrefix(body, "/**/" + callback + "({") || !strings.HasSuffix(body, "});") || !strings.Contains(body, `"subscriberId"`) {
+			t.Errorf("callback %q response %s", callback, body)
+		}
+	}
+}
+
+/**
+* responses from compressionThreshold are gzipped when client accepts gzip, smaller ones are sent unchanged
+*/
+func TestWriteCompressed(t *testing.T) {
+	for _, check := range([]struct {
+		size int
+		acceptEncoding string
+		gzipped bool
+	}{
+		{compressionThreshold, "gzip", true},
+		{compressionThreshold * 4, "deflate, gzip;q=0.5", true},
+		{compressionThreshold - 1, "gzip", false},
+		{compressionThreshold * 4, "", false},
+		{compressionThreshold * 4, "deflate, br", false},
+		{compressionThreshold * 4, "gzip;q=0", false},
+	}) {
+		var data = []byte(strings.Repeat("a", check.size))
+		var request = httptest.NewRequest("GET", "/data", nil)
+		if check.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", check.acceptEncoding)
+		}
+		var recorder = httptest.NewRecorder()
+		var mediator = HttpDataMediator{w: recorder, r: request, codec: JsonCodec}
+		mediator.writeCompressed(data)
+		if recorder.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%d bytes with %q: vary header %q", check.size, check.acceptEncoding, recorder.Header().Get("Vary"))
+		}
+		var body = recorder.Body.Bytes()
+		if check.gzipped {
+			if recorder.Header().Get("Content-Encoding") != "gzip" {
+				t.Errorf("%d bytes with %q not gzipped", check.size, check.acceptEncoding)
+				continue
+			}
+			reader, err := gzip.NewReader(recorder.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(reader); err != nil {
+				t.Fatal(err)
+			}
+		} else if recorder.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%d bytes with %q sent with content encoding %s", check.size, check.acceptEncoding, recorder.Header().Get("Content-Encoding"))
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("%d bytes with %q received %d bytes", check.size, check.acceptEncoding, len(body))
+		}
+	}
+}
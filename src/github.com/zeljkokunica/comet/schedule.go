@@ -0,0 +1,263 @@
+package comet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+	"github.com/zeljkokunica/l"
+)
+
+/**
+* create, update or clear waiting to be published at PublishAt
+*/
+type ScheduledPublish struct {
+	Id string `json:"id"`
+	Command string `json:"command"`
+	Channel string `json:"channel"`
+	Data string `json:"data"`
+	// content type declared by scheduled create
+	ContentType string `json:"contentType,omitempty"`
+	PublishAt time.Time `json:"publishAt"`
+	Created time.Time `json:"created"`
+}
+
+const (
+	scheduleAdd = 1
+	scheduleCancel = 2
+	scheduleList = 3
+)
+
+type scheduleProcessCommand struct {
+	command int
+	publish ScheduledPublish
+	responseListener chan scheduleProcessResponse
+}
+
+type scheduleProcessResponse struct {
+	publishes []ScheduledPublish
+	err error
+}
+
+
+/**
+* holds scheduled publishes ordered by time and publishes them when their time comes
+* schedule is persisted on every change and restored on start together with channels
+* publishes whose time passed while the hub was down are published on start
+*/
+func (h *Hub) scheduleProcess() {
+	l.I("schedule process - start")
+	defer l.I("schedule process - end")
+	var schedule = make([]ScheduledPublish, 0)
+	var scheduleFile = filepath.Join(h.config.DataDir, "scheduled", "publishes.json")
+	if !h.config.SkipRestore {
+		schedule = loadSchedule(scheduleFile)
+	}
+	// timer is started only when the first scheduled publish changes
+	var due <-chan time.Time
+	var dueAt time.Time
+	for {
+		if len(schedule) == 0 {
+			due = nil
+			dueAt = time.Time{}
+		} else if due == nil || !schedule[0].PublishAt.Equal(dueAt) {
+			dueAt = schedule[0].PublishAt
+			due = h.config.Clock.After(dueAt.Sub(h.config.Clock.Now()))
+		}
+		select {
+			case command := <- h.scheduleListener:
+				var response scheduleProcessResponse
+				switch command.command {
+					case scheduleAdd:
+						if len(schedule) >= maxScheduledPublishes {
+							response.err = newHubError(http.StatusServiceUnavailable, "limit of %d scheduled publishes reached", maxScheduledPublishes)
+							break
+						}
+						schedule = append(schedule, command.publish)
+						sort.SliceStable(schedule, func(i, j int) bool { return schedule[i].PublishAt.Before(schedule[j].PublishAt) })
+						saveSchedule(scheduleFile, schedule)
+						response.publishes = []ScheduledPublish{command.publish}
+					case scheduleCancel:
+						response.err = newHubError(http.StatusNotFound, "scheduled publish %s not found", command.publish.Id)
+						for i, publish := range(schedule) {
+							if publish.Id == command.publish.Id {
+								schedule = append(schedule[:i], schedule[i + 1:]...)
+								saveSchedule(scheduleFile, schedule)
+								response = scheduleProcessResponse{publishes: []ScheduledPublish{publish}}
+								break
+							}
+						}
+					case scheduleList:
+						response.publishes = make([]ScheduledPublish, 0)
+						for _, publish := range(schedule) {
+							if command.publish.Channel == "" || publish.Channel == command.publish.Channel {
+								response.publishes = append(response.publishes, publish)
+							}
+						}
+				}
+				command.responseListener <- response
+			case <- due:
+				due = nil
+				var now = h.config.Clock.Now()
+				var published = 0
+				for published < len(schedule) && !schedule[published].PublishAt.After(now) {
+					h.publishScheduled(schedule[published])
+					published++
+				}
+				if published > 0 {
+					schedule = schedule[published:]
+					saveSchedule(scheduleFile, schedule)
+				}
+		}
+	}
+}
+
+func (h *Hub) publishScheduled(publish ScheduledPublish) {
+	l.If("schedule process - publishing %s %s to %s", publish.Id, publish.Command, publish.Channel)
+	var err error
+	if publish.ContentType != "" {
+		err = h.ConfigureChannel(publish.Channel, func(options *ChannelOptions) { options.ContentType = publish.ContentType })
+	}
+	if err == nil {
+		err = h.AddNewDataToChannel(publish.Command, publish.Channel, publish.Data)
+	}
+	if err != nil {
+		l.Ef("schedule process - scheduled publish %s to %s failed: %s", publish.Id, publish.Channel, err.Error())
+	}
+}
+
+func loadSchedule(scheduleFile string) []ScheduledPublish {
+	var schedule = make([]ScheduledPublish, 0)
+	data, err := ioutil.ReadFile(scheduleFile)
+	if err != nil {
+		return schedule
+	}
+	if err = json.Unmarshal(data, &schedule); err != nil {
+		l.Ef("schedule process - could not restore schedule: %s", err.Error())
+		return make([]ScheduledPublish, 0)
+	}
+	sort.SliceStable(schedule, func(i, j int) bool { return schedule[i].PublishAt.Before(schedule[j].PublishAt) })
+	l.If("schedule process - restored %d scheduled publishes", len(schedule))
+	return schedule
+}
+
+/**
+* writes schedule to a temporary file first, so a crash never leaves it half written
+*/
+func saveSchedule(scheduleFile string, schedule []ScheduledPublish) {
+	data, _ := json.Marshal(schedule)
+	var err = os.MkdirAll(filepath.Dir(scheduleFile), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(scheduleFile + ".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(scheduleFile + ".tmp", scheduleFile)
+	}
+	if err != nil {
+		l.Ef("schedule process - could not save schedule: %s", err.Error())
+	}
+}
+
+func (h *Hub) scheduleRequest(command scheduleProcessCommand) scheduleProcessResponse {
+	var responseListener = make(chan scheduleProcessResponse)
+	defer close(responseListener)
+	command.responseListener = responseListener
+	h.scheduleListener <- command
+	return <- responseListener
+}
+
+/**
+* publish time from publishAt (RFC 3339 or unix milliseconds) or delay (milliseconds) parameter
+* returns false when publish is not scheduled
+*/
+func (h *Hub) readPublishTime(m DataMediator) (time.Time, bool, error) {
+	var publishAt = m.ReadParameter("publishAt")
+	var delay = m.ReadParameter("delay")
+	var now = h.config.Clock.Now()
+	var result time.Time
+	if publishAt != "" && delay != "" {
+		return result, false, newHubError(http.StatusBadRequest, "publishAt and delay can not be used together")
+	} else if publishAt != "" {
+		if milliseconds, err := strconv.ParseInt(publishAt, 10, 64); err == nil {
+			result = time.Unix(0, milliseconds * int64(time.Millisecond))
+		} else if result, err = time.Parse(time.RFC3339, publishAt); err != nil {
+			return result, false, newHubError(http.StatusBadRequest, "publishAt must be RFC 3339 time or unix milliseconds")
+		}
+	} else if delay != "" {
+		milliseconds, err := strconv.ParseInt(delay, 10, 64)
+		if err != nil || milliseconds < 0 {
+			return result, false, newHubError(http.StatusBadRequest, "invalid delay")
+		}
+		result = now.Add(time.Duration(milliseconds) * time.Millisecond)
+	} else {
+		return result, false, nil
+	}
+	if result.Sub(now) > h.config.MaxScheduleDelay {
+		return result, false, newHubError(http.StatusBadRequest, "publish can be scheduled at most %s ahead", h.config.MaxScheduleDelay)
+	}
+	return result, true, nil
+}
+
+/**
+* schedules create, update or clear to be published at publishAt
+*/
+func (h *Hub) SchedulePublish(command string, channel string, data string, contentType string, publishAt time.Time) (ScheduledPublish, error) {
+	if command != DataCreate && command != DataUpdate && command != DataClear {
+		return ScheduledPublish{}, newHubError(http.StatusBadRequest, "invalid scheduled operation '%s'", command)
+	}
+	if err := h.validateChannelData(channel, data); err != nil {
+		return ScheduledPublish{}, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return ScheduledPublish{}, err
+	}
+	var publish = ScheduledPublish{Id: id, Command: command, Channel: channel, Data: data, ContentType: contentType, PublishAt: publishAt.UTC(), Created: h.config.Clock.Now().UTC()}
+	var response = h.scheduleRequest(scheduleProcessCommand{command: scheduleAdd, publish: publish})
+	return publish, response.err
+}
+
+/**
+* schedules create, update or clear request with publishAt or delay parameter
+* returns false if request is not scheduled
+*/
+func (h *Hub) scheduleDataRequest(m DataMediator, command string, data string) bool {
+	publishAt, scheduled, err := h.readPublishTime(m)
+	if err == nil && scheduled {
+		var publish ScheduledPublish
+		publish, err = h.SchedulePublish(command, m.ReadParameter("channel"), data, m.ReadParameter("contentType"), publishAt)
+		if err == nil {
+			m.WriteResponse(publish, "json")
+		}
+	}
+	if err != nil {
+		writeHubError(m, err)
+		return true
+	}
+	return scheduled
+}
+
+/**
+* lists pending scheduled publishes, of a channel if channel parameter is set
+*/
+func (h *Hub) onScheduledRequest(m DataMediator) {
+	var response = h.scheduleRequest(scheduleProcessCommand{command: scheduleList, publish: ScheduledPublish{Channel: m.ReadParameter("channel")}})
+	m.WriteResponse(response.publishes, "json")
+}
+
+/**
+* cancels scheduled publish
+* parameters: scheduleId
+*/
+func (h *Hub) onCancelScheduledRequest(m DataMediator) {
+	var response = h.scheduleRequest(scheduleProcessCommand{command: scheduleCancel, publish: ScheduledPublish{Id: m.ReadParameter("scheduleId")}})
+	if response.err != nil {
+		writeHubError(m, response.err)
+		return
+	}
+	m.WriteResponse(response.publishes[0], "json")
+}
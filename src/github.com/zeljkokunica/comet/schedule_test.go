@@ -0,0 +1,137 @@
+package comet
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestScheduleHub(t *testing.T) (*Hub, *fakeClock) {
+	var clock = newFakeClock()
+	var config = newTestHubConfig(t)
+	config.Clock = clock
+	return NewHub(config), clock
+}
+
+func scheduleTestPublish(t *testing.T, hub *Hub, channel string, data string, delay time.Duration) ScheduledPublish {
+	publish, err := hub.SchedulePublish(DataCreate, channel, data, "", hub.config.Clock.Now().Add(delay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publish
+}
+
+func listTestSchedule(hub *Hub, channel string) []ScheduledPublish {
+	return hub.scheduleRequest(scheduleProcessCommand{command: scheduleList, publish: ScheduledPublish{Channel: channel}}).publishes
+}
+
+/**
+* scheduled publish is published asynchronously - waits until channel holds data
+*/
+func waitForTestChannelData(t *testing.T, hub *Hub, channel string, data string) {
+	var deadline = time.Now().Add(5 * time.Second)
+	for {
+		current, err := hub.getChannelData(channel, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Data == data {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("channel %s holds '%s', expected '%s'", channel, current.Data, data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulePublishesWhenDue(t *testing.T) {
+	hub, clock := newTestScheduleHub(t)
+	scheduleTestPublish(t, hub, "scheduled", "due", time.Minute)
+	clock.Advance(30 * time.Second)
+	if publishes := listTestSchedule(hub, ""); len(publishes) != 1 {
+		t.Fatalf("%d scheduled publishes before due, expected 1", len(publishes))
+	}
+	current, err := hub.getChannelData("scheduled", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Data != "" {
+		t.Fatalf("published '%s' before due", current.Data)
+	}
+	clock.Advance(30 * time.Second)
+	waitForTestChannelData(t, hub, "scheduled", "due")
+	if publishes := listTestSchedule(hub, ""); len(publishes) != 0 {
+		t.Fatalf("%d scheduled publishes after due, expected 0", len(publishes))
+	}
+}
+
+func TestScheduleCancel(t *testing.T) {
+	hub, clock := newTestScheduleHub(t)
+	var cancelled = scheduleTestPublish(t, hub, "cancelled", "cancelled", time.Minute)
+	scheduleTestPublish(t, hub, "published", "published", 2 * time.Minute)
+	var response = hub.scheduleRequest(scheduleProcessCommand{command: scheduleCancel, publish: ScheduledPublish{Id: cancelled.Id}})
+	if response.err != nil {
+		t.Fatal(response.err)
+	}
+	if len(response.publishes) != 1 || response.publishes[0].Id != cancelled.Id {
+		t.Fatalf("cancel returned %v, expected %s", response.publishes, cancelled.Id)
+	}
+	response = hub.scheduleRequest(scheduleProcessCommand{command: scheduleCancel, publish: ScheduledPublish{Id: cancelled.Id}})
+	if hubErr, ok := response.err.(*HubError); !ok || hubErr.Code != 404 {
+		t.Fatalf("second cancel returned %v, expected 404", response.err)
+	}
+	clock.Advance(2 * time.Minute)
+	// publishes go out in time order - once the later one is out the cancelled one would have been too
+	waitForTestChannelData(t, hub, "published", "published")
+	current, err := hub.getChannelData("cancelled", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Data != "" {
+		t.Fatalf("cancelled publish published '%s'", current.Data)
+	}
+}
+
+func TestScheduleList(t *testing.T) {
+	hub, _ := newTestScheduleHub(t)
+	var later = scheduleTestPublish(t, hub, "first", "later", 2 * time.Minute)
+	var sooner = scheduleTestPublish(t, hub, "first", "sooner", time.Minute)
+	var other = scheduleTestPublish(t, hub, "second", "other", 90 * time.Second)
+	var all = listTestSchedule(hub, "")
+	if len(all) != 3 || all[0].Id != sooner.Id || all[1].Id != other.Id || all[2].Id != later.Id {
+		t.Fatalf("listed %v, expected publishes ordered by time", all)
+	}
+	var first = listTestSchedule(hub, "first")
+	if len(first) != 2 || first[0].Id != sooner.Id || first[1].Id != later.Id {
+		t.Fatalf("listed %v for channel first", first)
+	}
+	if none := listTestSchedule(hub, "none"); len(none) != 0 {
+		t.Fatalf("listed %v for channel without publishes", none)
+	}
+}
+
+/**
+* schedule is restored from data dir - publishes due while the hub was down go out on start
+*/
+func TestScheduleRestoredAfterRestart(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.SkipRestore = false
+	var stoppedClock = newFakeClock()
+	config.Clock = stoppedClock
+	var hub = NewHub(config)
+	var missed = scheduleTestPublish(t, hub, "missed", "missed", time.Minute)
+	var pending = scheduleTestPublish(t, hub, "pending", "pending", time.Hour)
+
+	// first hub clock never moves so only the restarted hub publishes
+	var clock = newFakeClock()
+	clock.Advance(2 * time.Minute)
+	config.Clock = clock
+	var restarted = NewHub(config)
+	waitForTestChannelData(t, restarted, "missed", "missed")
+	var publishes = listTestSchedule(restarted, "")
+	if len(publishes) != 1 || publishes[0].Id != pending.Id || !publishes[0].PublishAt.Equal(pending.PublishAt) {
+		t.Fatalf("restored %v, expected only %s (missed %s)", publishes, pending.Id, missed.Id)
+	}
+	clock.Advance(time.Hour)
+	waitForTestChannelData(t, restarted, "pending", "pending")
+}
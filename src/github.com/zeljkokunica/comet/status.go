@@ -4,38 +4,48 @@ import (
 	"strconv"
 	"runtime"
 	"encoding/json"
-	"time"
 	"github.com/zeljkokunica/l"
 )
 
+/**
+* status is published to system channel - subscriber id authorizes requests and is not included
+*/
 type HubStatusSubscriber struct {
-	Id string `json:"id"`
+	Identity string `json:"identity,omitempty"`
 	Channels []string `json:"channels"`
 }
 type HubStatusChannel struct {
 	ChannelName string `json:"channelName"`
 	DataVersion int64 `json:"dataVersion"`
 }
+type HubStatusQueue struct {
+	ChannelName string `json:"channelName"`
+	Pending int `json:"pending"`
+	InFlight int `json:"inFlight"`
+	Consumers int `json:"consumers"`
+}
 type HubStatus struct {
 	Subscribers []HubStatusSubscriber `json:"subscribers"`
 	Channels []HubStatusChannel `json:"channels"`
+	Queues []HubStatusQueue `json:"queues"`
 	Statistics map[string]string `json:"statistics"`
 }
 
+/**
+* subscribers and channels are owned by their processes, status asks them for a copy
+*/
 func createHubStatus(h *Hub) HubStatus{
-	var subscribers = make([]HubStatusSubscriber, 0)
-	
-	for _, subscriber := range(h.subscribers) {
-		subscribers = append(subscribers, HubStatusSubscriber{Id: subscriber.id})
-	}
-	
-	var channels = make([]HubStatusChannel, 0)
-	for _, channel := range(h.repository.channels) {
-		channels = append(channels, HubStatusChannel{ChannelName: channel.ChannelName})
-	}
+	var subscribers = h.requestSubscriber(HubSubscriberRequest{command: GetSubscribersStatus}).status
+	var channelsListener = make(chan []HubStatusChannel)
+	h.repository.statusListener <- channelsListener
+	var channels = <- channelsListener
 	var stats = make(map[string]string, 0)
 	stats["routines"] = strconv.Itoa(runtime.NumGoroutine())
-	var result = HubStatus{Subscribers: subscribers, Channels: channels, Statistics: stats}
+	stats["rateLimitedAddress"] = strconv.FormatInt(h.addressLimiter.Limited(), 10)
+	stats["rateLimitedSubscriber"] = strconv.FormatInt(h.subscriberLimiter.Limited(), 10)
+	stats["rateLimitedChannel"] = strconv.FormatInt(h.channelLimiter.Limited(), 10)
+	var queues = h.queueProcess(queueProcessCommand{command: queueStatus}).status
+	var result = HubStatus{Subscribers: subscribers, Channels: channels, Queues: queues, Statistics: stats}
 	return result 
 }
 
@@ -44,9 +54,12 @@ func (h *Hub) refreshStatusProcess() {
 	defer l.I("status process - end")
 	for {
 			var data, _ = json.Marshal(createHubStatus(h))
-			h.subscriberCommandListener <- HubSubscriberRequest{CleanupSubscribers, "", nil, nil}
-			h.AddNewDataToChannel("create", "system", string(data))
+			h.subscriberCommandListener <- HubSubscriberRequest{command: CleanupSubscribers}
+			h.addressLimiter.cleanup()
+			h.subscriberLimiter.cleanup()
+			h.channelLimiter.cleanup()
+			h.addNewDataToChannel(ChannelDataInputCommand{Command: "create", ChannelName: "system", Data: string(data)})
 			l.I("status process - checked system")
-			time.Sleep(refreshStatusPeriod)
+			<- h.config.Clock.After(h.config.RefreshStatusPeriod)
 		}
 }
@@ -0,0 +1,46 @@
+package comet
+
+import (
+	"encoding/json"
+	"github.com/zeljkokunica/l"
+)
+
+func writeStreamLine(m StreamDataMediator, response SubscriberResponse) error {
+	jsonData, _ := json.Marshal(response)
+	return m.WriteStream(append(jsonData, '\n'))
+}
+
+/**
+* streaming long poll (data?id=...&stream=true)
+* keeps response open and writes each SubscriberResponse as a line of json (status 0 when idle)
+* response is closed after StreamMaxDuration of hub config, or with status -1 when subscriber times out
+*/
+func (h *Hub) streamData(m StreamDataMediator, subscriber *Subscriber) {
+	var subscriberId = subscriber.id
+	l.If("stream process - %s - start", subscriberId)
+	defer l.If("stream process - %s - stop", subscriberId)
+
+	m.StartStream("application/x-ndjson")
+	var heartbeat = h.config.Clock.NewTicker(h.config.StreamHeartbeatPeriod)
+	defer heartbeat.Stop()
+	var maxDuration = h.config.Clock.After(h.config.StreamMaxDuration)
+	var err error
+	for err == nil {
+		select {
+			case command := <- subscriber.feedListener:
+				err = writeStreamLine(m, SubscriberResponse{Status: 1, Commands: command.data})
+			case <- heartbeat.C():
+				if _, found := h.touchSubscriber(subscriberId); !found {
+					l.Wf("stream process - %s - timed out!", subscriberId)
+					writeStreamLine(m, SubscriberResponse{Status: -1})
+					return
+				}
+				err = writeStreamLine(m, SubscriberResponse{Status: 0})
+			case <- maxDuration:
+				return
+			case <- m.Done():
+				return
+		}
+	}
+	l.If("stream process - %s - error writing: %s", subscriberId, err.Error())
+}
@@ -0,0 +1,65 @@
+package comet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+* stream heartbeats touch subscriber while other subscribers come and go
+*/
+func TestStreamHeartbeatWhileSubscribing(t *testing.T) {
+	var config = newTestHubConfig(t)
+	config.StreamHeartbeatPeriod = time.Millisecond
+	var hub = NewHub(config)
+	var server = httptest.NewServer(hub)
+	defer server.Close()
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	response, err := http.Get(server.URL + "/data?stream=true&id=" + subscriber.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	for i := 0; i < 50; i++ {
+		var other = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}})
+		hub.requestSubscriber(HubSubscriberRequest{command: Unsubscribe, subscriberId: other.subscriber.id})
+	}
+	hub.addNewDataToChannel(ChannelDataInputCommand{Command: DataUpdate, ChannelName: "news", Data: "first"})
+	var reader = bufio.NewReader(response.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var streamed SubscriberResponse
+		if err = json.Unmarshal(line, &streamed); err != nil {
+			t.Fatalf("invalid stream line %s", line)
+		}
+		if streamed.Status == 1 && streamed.Commands[len(streamed.Commands) - 1].Data == "first" {
+			break
+		}
+	}
+}
+
+func TestStreamRejectsCallback(t *testing.T) {
+	var hub = newTestHub(t)
+	var server = httptest.NewServer(hub)
+	defer server.Close()
+	var subscriber = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}}).subscriber
+	response, err := http.Get(server.URL + "/data?stream=true&callback=cb&id=" + subscriber.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	// jsonp errors are passed to callback
+	body, _ := ioutil.ReadAll(response.Body)
+	if !strings.Contains(string(body), "cb(") || !strings.Contains(string(body), `"code":400`) {
+		t.Errorf("response %s, expected error 400 passed to callback", body)
+	}
+}
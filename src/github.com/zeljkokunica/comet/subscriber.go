@@ -1,20 +1,61 @@
 package comet
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"time"
 	"github.com/zeljkokunica/l"
 )
 
 const (
 	SubscriberFeed = 1
-	SubscriberStop = 2
+	SubscriberAddChannel = 3
 )
+
+/**
+* sent when channel versions were skipped - carries fresh channel data (as create), followed by channel updates
+* sent by client to get fresh channel data
+*/
+const DataResync = "resync"
+
+/**
+* subscription modes
+* snapshot - channel data and all updates, followed by new data
+* deltas - only new data
+* latest - only the newest data of a channel, data waiting to be delivered is replaced by newer
+*/
+const (
+	SubscriptionSnapshot = "snapshot"
+	SubscriptionDeltas = "deltas"
+	SubscriptionLatest = "latest"
+)
+
+/**
+* options of channels added by subscribe/addchannels request
+*/
+type SubscriptionOptions struct {
+	Mode string
+	// presence identity and metadata, sent in join/leave events of channels with presence
+	Identity string
+	Metadata string
+	// filter expression of channel updates, parsed into filter
+	Filter string
+	filter *dataFilter
+	// comma separated json fields of channel data sent to subscriber, parsed into projection
+	Fields string
+	projection *dataProjection
+}
+
 /** 
 *	control messages for subscriberProcess
 **/
 type SubscriberControlCommand struct {
 	command int
 	SubscriberFeedCommand
+	// added channel for SubscriberAddChannel, data is channel snapshot
+	channel SubscriberChannel
+	// data published by the subscriber itself, which does not want it back
+	noEcho bool
 }
 
 /** 
@@ -24,10 +65,10 @@ type SubscriberFeedCommand struct {
 	data []SubscriberResponseCommand
 }
 
-func CreateSingleFeedCommad(command string, channel string, data string, dataVersion int64) SubscriberFeedCommand {
+func CreateSingleFeedCommad(command string, channel string, data string, dataVersion int64, contentType string) SubscriberFeedCommand {
 	result := SubscriberFeedCommand{}
 	result.data = make([]SubscriberResponseCommand, 1)
-	result.data[0] = SubscriberResponseCommand{command, channel, data, dataVersion}
+	result.data[0] = SubscriberResponseCommand{Command: command, Channel: channel, Data: data, DataVersion: dataVersion, ContentType: contentType}
 	return result
 } 
 
@@ -36,15 +77,48 @@ func CreateSingleFeedCommad(command string, channel string, data string, dataVer
 */
 type SubscriberChannel struct {
 	channelName string
+	// version of the last data sent to the subscriber, or left out for it
 	dataVersion int64
+	// version of the last data queued for the client
+	deliveredVersion int64
+	mode string
+	// newest version not delivered because subscriber queue was full, -1 if none
+	droppedVersion int64
+	// subscriber is a presence member of the channel
+	presence bool
+	// subscriber is a consumer of queue channel
+	queue bool
+	// updates not matching filter are not delivered, nil for all updates
+	filter *dataFilter
+	// fields of channel data sent to the subscriber, nil for whole data
+	projection *dataProjection
 }
 
 type Subscriber struct {
 	id string
+	// stamped on data the subscriber publishes - subscriber id authorizes requests and is never shown to others
+	publisherId string
 	channels map[string]*SubscriberChannel
 	commandListener chan SubscriberControlCommand
 	feedListener chan SubscriberFeedCommand
-	lastRequest int64
+	// closed by hub when subscriber is deleted - unlike a command it can not be lost on a full commandListener
+	stop chan bool
+	// closed when subscriberCommandProcess ends
+	stopped chan bool
+	lastRequest time.Time
+	// presence identity and metadata supplied by client
+	identity string
+	metadata string
+}
+
+/**
+* sends command to subscriber process, does nothing if process is already stopped
+*/
+func (s *Subscriber) send(command SubscriberControlCommand) {
+	select {
+		case s.commandListener <- command:
+		case <- s.stopped:
+	}
 }
 
 /**
@@ -55,6 +129,31 @@ type SubscriberResponseCommand struct {
 	Channel string `json:"channel"`
 	Data string `json:"data"`
 	DataVersion int64 `json:"version"`
+	ContentType string `json:"contentType,omitempty"`
+	// publisher id of client which published the data
+	Publisher string `json:"publisher,omitempty"`
+	// request/reply correlation id
+	CorrelationId string `json:"correlationId,omitempty"`
+	// versions before this data not sent to the subscriber on purpose (filtered out, own data without echo)
+	// client has a gap only when version - skipped is past its next version
+	Skipped int64 `json:"skipped,omitempty"`
+}
+
+type subscriberResponseCommandJson SubscriberResponseCommand
+
+/**
+* data of binary channels is sent base64 encoded, with encoding set to base64
+*/
+func (c SubscriberResponseCommand) MarshalJSON() ([]byte, error) {
+	var result = struct {
+		subscriberResponseCommandJson
+		Encoding string `json:"encoding,omitempty"`
+	}{subscriberResponseCommandJson: subscriberResponseCommandJson(c)}
+	if isBinaryContentType(c.ContentType) {
+		result.Data = base64.StdEncoding.EncodeToString([]byte(c.Data))
+		result.Encoding = "base64"
+	}
+	return json.Marshal(result)
 }
 /**
 * complete response to client
@@ -65,32 +164,61 @@ type SubscriberResponse struct {
 }
 /**
 * process subscriber commands
-* when feed command is received, data must be received within 30 seconds or subscriber will unsubscribe
+* data is collected until the client takes it (long poll request, websocket writer...) as a single feed command
+* when data is waiting, it must be received within FeedTimeout of hub config or subscriber will unsubscribe
 */
 func (s *Subscriber) subscriberCommandProcess(h *Hub) {
 	l.If("subscriber process - %s - start", s.id)
-  defer l.If("subscriber process - %s - end", s.id)
-  
+	defer l.If("subscriber process - %s - end", s.id)
+	defer close(s.stopped)
+
+	var feed = newSubscriberFeed(s.id, h)
+	var pendingSince time.Time
+	// started once data is waiting and kept until it is taken
+	var feedTimeout <-chan time.Time
+	var aliveTicker = h.config.Clock.NewTicker(h.config.AliveLogPeriod)
+	defer aliveTicker.Stop()
 	for {
+		// nil channels disable feeding while there is no data
+		var feedListener chan SubscriberFeedCommand
+		if len(feed.pending) > 0 {
+			feedListener = s.feedListener
+			if feedTimeout == nil {
+				feedTimeout = h.config.Clock.After(h.config.FeedTimeout - h.config.Clock.Now().Sub(pendingSince))
+			}
+		} else {
+			feedTimeout = nil
+		}
 		select {
+			case <- s.stop:
+				l.If("subscriber process - %s - stop", s.id)
+				return
 			case subscriberCommand := <-s.commandListener:
 				switch subscriberCommand.command {
-					case SubscriberStop:
-						l.If("subscriber process - %s - stop", s.id)
-						return
-					case SubscriberFeed:
+					case SubscriberFeed, SubscriberAddChannel:
 						l.If("subscriber process - %s - feed", s.id)
-						select {
-							case s.feedListener <- subscriberCommand.SubscriberFeedCommand:
-							case <- time.After(30 * time.Second):
-								l.Wf("subscriber process - %s - feed timedout", s.id) 
-								h.subscriberCommandListener <- HubSubscriberRequest{Unsubscribe, s.id, nil, nil}
-								return
+						if len(feed.pending) == 0 {
+							pendingSince = h.config.Clock.Now()
+						}
+						if subscriberCommand.command == SubscriberAddChannel {
+							feed.addChannel(subscriberCommand.channel, subscriberCommand.data)
+						} else {
+							feed.add(subscriberCommand.data, subscriberCommand.noEcho)
+						}
+						if len(feed.pending) > h.config.SubscriberQueueSize {
+							l.Wf("subscriber process - %s - queue full, conflating %d commands", s.id, len(feed.pending))
+							feed.conflate(h.config.SubscriberQueueSize)
 						}
 				}
-			case <- time.After(30 * time.Second):
-    		l.If("subscriber process - %s - alive", s.id)
+			case feedListener <- SubscriberFeedCommand{data: feed.pending}:
+				feed.clear()
+			case <- feedTimeout:
+				l.Wf("subscriber process - %s - feed timedout", s.id) 
+				h.subscriberCommandListener <- HubSubscriberRequest{command: Unsubscribe, subscriberId: s.id}
+				return
+			case <- aliveTicker.C():
+				l.If("subscriber process - %s - alive", s.id)
 		}
 	}
 	
-} 
+}
@@ -1,14 +1,29 @@
 package comet
 
 import (
-	"code.google.com/p/go.net/websocket"
+	"github.com/gorilla/websocket"
 	"encoding/json"
 	"github.com/zeljkokunica/l"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 )
 
+const (
+	// close code sent when subscriber was removed by the hub
+	CloseSubscriberTimeout = 4001
+)
+
+var websocketUpgrader = websocket.Upgrader{
+	ReadBufferSize: 4096,
+	WriteBufferSize: 4096,
+	EnableCompression: true,
+	Subprotocols: []string{"comet.json", "comet.msgpack", "comet.cbor"},
+	// origin is checked by hub against allowed origins before upgrade
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
 type WebSocketCommand struct {
 	RequestId int64 `json:"requestId"`
 	Command string `json:"command"`
@@ -18,107 +33,368 @@ type WebSocketCommand struct {
 type WebSocketResponse struct {
 	RequestId int64 `json:"requestId"`
 	Data interface{} `json:"data"`
+	Error *ErrorResponse `json:"error,omitempty"`
 }
 
 type WebSocketDataMediator struct {
   RequestId int64
 	send chan WebSocketResponse
+	// closed when connection stops, nil blocks until response is sent
+	closed chan bool
 	command WebSocketCommand
+	remoteAddr string
 }
 
 func (m *WebSocketDataMediator) ReadParameter(parameterName string) string {
-	return fmt.Sprint(m.command.Parameters[parameterName])
+	var value, found = m.command.Parameters[parameterName]
+	if !found || value == nil {
+		return ""
+	}
+	// raw binary parameters from msgpack/cbor commands
+	if bytesValue, ok := value.([]byte); ok {
+		return string(bytesValue)
+	}
+	return fmt.Sprint(value)
 }
 
 func (m *WebSocketDataMediator) WriteResponse(response interface{}, responseType string)  {
-	m.send <- WebSocketResponse{RequestId: m.RequestId, Data: response}
+	m.write(WebSocketResponse{RequestId: m.RequestId, Data: response})
+}
+
+func (m *WebSocketDataMediator) WriteError(code int, message string) {
+	m.write(WebSocketResponse{RequestId: m.RequestId, Error: &ErrorResponse{Code: code, Error: message}})
 }
 
+/**
+* response written after the socket was closed (by a backend request) is dropped
+*/
+func (m *WebSocketDataMediator) write(response WebSocketResponse) {
+	select {
+		case m.send <- response:
+		case <- m.closed:
+	}
+}
+
+func (m *WebSocketDataMediator) RemoteAddr() string {
+	return m.remoteAddr
+}
+
+/**
+* websocket connection lifecycle:
+* - writer is started together with reader and runs until reader exits
+* - subscribe hands the subscriber to the writer through subscribed listener
+* - when reader exits (socket closed or failed) closeListener is closed and subscriber is unsubscribed immediately
+*/
 type WebSocketHandler struct {
 	ws *websocket.Conn
 	hub *Hub
 	send chan WebSocketResponse
+	subscribed chan Subscriber
 	closeListener chan bool
 	subscriber Subscriber
+	remoteAddr string
+	// key sent when connection was opened, used by commands without their own key
+	key string
+	// encoding of commands and responses, selected by subprotocol or format parameter
+	codec Codec
+}
+
+func newWebSocketHandler(h *Hub, ws *websocket.Conn, remoteAddr string, codec Codec) *WebSocketHandler {
+	return &WebSocketHandler{
+		ws: ws,
+		hub: h,
+		send: make(chan WebSocketResponse, 255),
+		subscribed: make(chan Subscriber, 1),
+		closeListener: make(chan bool),
+		remoteAddr: remoteAddr,
+		codec: codec,
+	}
+}
+
+/**
+* runs connection until socket is closed
+*/
+func (m *WebSocketHandler) serve() {
+	var writerStopped = make(chan bool)
+	go func() {
+		m.writer()
+		close(writerStopped)
+	}()
+	m.reader()
+	close(m.closeListener)
+	<- writerStopped
+	m.unsubscribe()
+	m.ws.Close()
+}
+
+/**
+* sends close frame with code and reason, writer is stopped when reader exits
+*/
+func (m *WebSocketHandler) closeWithReason(code int, reason string) {
+	var message = websocket.FormatCloseMessage(code, reason)
+	var err = m.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(m.hub.config.WsWriteWait))
+	if err != nil {
+		l.If("wsreader process - %s - error sending close: %s", m.subscriber.id, err.Error())
+	}
+}
+
+/**
+* refreshes subscriber last request time, returns false if subscriber does not exist anymore
+*/
+func (m *WebSocketHandler) keepAlive() bool {
+	_, found := m.hub.touchSubscriber(m.subscriber.id)
+	return found
+}
+
+/**
+* removes subscriber of this connection from the hub, does not wait for hub to process it
+*/
+func (m *WebSocketHandler) unsubscribe() {
+	if m.subscriber.id == "" {
+		return
+	}
+	l.If("wsreader process - %s - unsubscribe", m.subscriber.id)
+	m.hub.subscriberCommandListener <- HubSubscriberRequest{command: Unsubscribe, subscriberId: m.subscriber.id}
+	m.subscriber = Subscriber{}
 }
 
 func (m *WebSocketHandler) reader() {
 	l.I("wsreader process - starting")
 	var subscriberId string = "anonymous"
+	m.ws.SetReadLimit(int64(m.hub.config.MaxDataSize) + wsMessageOverhead)
+	m.ws.SetReadDeadline(time.Now().Add(m.hub.config.WsPongWait))
+	m.ws.SetPongHandler(func(string) error {
+		m.ws.SetReadDeadline(time.Now().Add(m.hub.config.WsPongWait))
+		if m.subscriber.id != "" && !m.keepAlive() {
+			l.Wf("wsreader process - %s - timed out!", subscriberId)
+			m.closeWithReason(CloseSubscriberTimeout, "subscriber timed out")
+		}
+		return nil
+	})
 	for {
-  	var message string
-    err := websocket.Message.Receive(m.ws, &message)
-    if err != nil {
-    	l.If("wsreader process - %s - error reading from socket: %s", subscriberId, err.Error())
-    	break
-    }
-    l.If("wsreader process - read from socket %s", string(message))
-    var command = new (WebSocketCommand)
-    err = json.Unmarshal([]byte(message), command)
-    if err != nil {
-    	l.Ef("wsreader process - %s - error unmarshal commad %s", subscriberId, err.Error())
-    	break
-    }
-    var mediator = WebSocketDataMediator{send: m.send, command: *command, RequestId: command.RequestId}
-    // special commands - keep alive and subscribe
-    if command.Command == "keepAlive" {
-  	  var subscriber = m.hub.subscribers[m.subscriber.id]
-			// subscriber not found
-			if (subscriber == nil) {
+		messageType, message, err := m.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				l.If("wsreader process - %s - error reading from socket: %s", subscriberId, err.Error())
+			}
+			break
+		}
+		m.ws.SetReadDeadline(time.Now().Add(m.hub.config.WsPongWait))
+		var command = new (WebSocketCommand)
+		if messageType == websocket.BinaryMessage {
+			err = m.codec.Unmarshal(message, command)
+		} else {
+			err = json.Unmarshal(message, command)
+		}
+		if err != nil {
+			l.Ef("wsreader process - %s - error unmarshal commad %s", subscriberId, err.Error())
+			m.closeWithReason(websocket.CloseUnsupportedData, "invalid command")
+			break
+		}
+		l.If("wsreader process - %s - read command %d %s %v", subscriberId, command.RequestId, command.Command, redactedParameters(command.Parameters))
+		if _, found := command.Parameters["key"]; !found && m.key != "" {
+			if command.Parameters == nil {
+				command.Parameters = make(map[string]interface{})
+			}
+			command.Parameters["key"] = m.key
+		}
+		if m.subscriber.id != "" && command.Command != "subscribe" {
+			// commands are sent by the subscriber of this socket (requester, publisher, rate limits)
+			if command.Parameters == nil {
+				command.Parameters = make(map[string]interface{})
+			}
+			// socket can act only as its own subscriber
+			command.Parameters["id"] = m.subscriber.id
+		}
+		var mediator = WebSocketDataMediator{send: m.send, closed: m.closeListener, command: *command, RequestId: command.RequestId, remoteAddr: m.remoteAddr}
+		// special commands - keep alive and subscribe
+		// keepAlive is kept for older clients, protocol ping/pong keeps subscriber alive
+		if command.Command == "keepAlive" {
+			if !m.keepAlive() {
 				l.Wf("wsreader process - %s - timed out!", subscriberId)
-    		break
-    	} else {
-    		subscriber.lastRequest = time.Now().Unix()
-    	}	
-    } else if command.Command == "subscribe" {
-    	var channels = strings.Split(mediator.ReadParameter("channels"), ",")
-			var responseListener = make(chan Subscriber)
-			m.hub.subscriberCommandListener <- HubSubscriberRequest{command: Subscribe, channels: channels, responseListener: responseListener}
-			m.subscriber = <- responseListener
+				m.closeWithReason(CloseSubscriberTimeout, "subscriber timed out")
+				break
+			}
+		} else if command.Command == "subscribe" {
+			if !m.hub.allowRequest(command.Command, &mediator) || !m.hub.authorize(accessSubscribe, &mediator) {
+				continue
+			}
+			var channels = strings.Split(mediator.ReadParameter("channels"), ",")
+			options, err := m.hub.readSubscriptionOptions(&mediator)
+			if err != nil {
+				writeHubError(&mediator, err)
+				continue
+			}
+			var response = m.hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: channels, options: options})
+			if response.err != nil {
+				writeHubError(&mediator, response.err)
+				continue
+			}
+			// subscribing again replaces previous subscriber
+			m.unsubscribe()
+			m.subscriber = response.subscriber
 			subscriberId = m.subscriber.id
-			go m.writer()
-			mediator.WriteResponse(map[string]interface{}{"command": "subscribe", "subscriberId": m.subscriber.id}, "json");
-			close(responseListener)
-    } else {
-    	m.hub.route(command.Command, &mediator)
-    }
-  }
-  m.closeListener <- true
-  l.If("wsreader process - %s - stopped", subscriberId)
-  m.ws.Close()
+			mediator.WriteResponse(map[string]interface{}{"command": "subscribe", "subscriberId": m.subscriber.id, "publisherId": m.subscriber.publisherId}, "json");
+			m.subscribed <- m.subscriber
+		} else if command.Command == "publish" || command.Command == DataCreate || command.Command == DataUpdate || command.Command == DataClear {
+			m.publish(&mediator)
+		} else if command.Command == "configure" {
+			mediator.WriteError(http.StatusForbidden, "channels can not be configured over web socket")
+		} else if route, path := m.hub.backendRoutes.match(command.Command); route != nil {
+			// upstream may be slow, reader keeps serving other commands
+			if m.hub.allowRequest(command.Command, &mediator) && m.hub.authorize(accessSubscribe, &mediator) {
+				go m.hub.onBackendRequest(route, path, &mediator)
+			}
+		} else {
+			m.hub.route(command.Command, &mediator)
+		}
+	}
+	l.If("wsreader process - %s - stopped", subscriberId)
+}
+
+/**
+* client publishes data to a channel which allows it
+* parameters: channel, data, encoding, operation (for publish command - update by default), echo (false - do not receive own data)
+*/
+func (m *WebSocketHandler) publish(mediator *WebSocketDataMediator) {
+	var operation = mediator.command.Command
+	if operation == "publish" {
+		operation = mediator.ReadParameter("operation")
+		if operation == "" {
+			operation = DataUpdate
+		}
+	}
+	if m.subscriber.id == "" {
+		mediator.WriteError(http.StatusForbidden, "subscribe before publishing")
+		return
+	}
+	// client publish needs only subscribe access, channel must allow it
+	if !m.hub.allowRequest(operation, mediator) || !m.hub.authorize(accessSubscribe, mediator) {
+		return
+	}
+	var channel = mediator.ReadParameter("channel")
+	data, err := readData(mediator)
+	if err == nil {
+		err = m.hub.PublishToChannel(operation, channel, data, m.subscriber.publisherId, mediator.ReadParameter("echo") != "false")
+	}
+	if err != nil {
+		writeHubError(mediator, err)
+		return
+	}
+	mediator.WriteResponse(map[string]interface{}{"command": operation, "channel": channel}, "json")
+}
+
+/**
+* encodes message with connection codec and sends it
+*/
+func (m *WebSocketHandler) write(message interface{}) error {
+	data, err := m.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if m.codec.Binary() {
+		return m.writeMessage(websocket.BinaryMessage, data)
+	}
+	return m.writeMessage(websocket.TextMessage, data)
+}
+
+func (m *WebSocketHandler) writeMessage(messageType int, data []byte) error {
+	m.ws.SetWriteDeadline(time.Now().Add(m.hub.config.WsWriteWait))
+	// no-op when permessage-deflate was not negotiated
+	m.ws.EnableWriteCompression(len(data) >= compressionThreshold)
+	return m.ws.WriteMessage(messageType, data)
 }
 
+/**
+* header of binary frame, followed by new line and raw data
+*/
+type webSocketBinaryHeader struct {
+	Command string `json:"command"`
+	Channel string `json:"channel"`
+	DataVersion int64 `json:"version"`
+	ContentType string `json:"contentType"`
+	Publisher string `json:"publisher,omitempty"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	Skipped int64 `json:"skipped,omitempty"`
+}
+
+/**
+* sends subscriber data - text commands as json SubscriberResponse, binary commands each in its own binary frame
+* order of commands is kept
+* binary codecs carry binary data themselves - all commands are sent in one SubscriberResponse
+*/
+func (m *WebSocketHandler) writeFeed(commands []SubscriberResponseCommand) error {
+	if m.codec.Binary() {
+		return m.write(SubscriberResponse{Status: 1, Commands: commands})
+	}
+	var textCommands = make([]SubscriberResponseCommand, 0, len(commands))
+	var writeText = func() error {
+		if len(textCommands) == 0 {
+			return nil
+		}
+		var response = SubscriberResponse{Status: 1, Commands: textCommands}
+		var err = m.write(response)
+		textCommands = make([]SubscriberResponseCommand, 0, len(commands))
+		return err
+	}
+	for _, command := range(commands) {
+		if !isBinaryContentType(command.ContentType) {
+			textCommands = append(textCommands, command)
+			continue
+		}
+		if err := writeText(); err != nil {
+			return err
+		}
+		header, _ := json.Marshal(webSocketBinaryHeader{command.Command, command.Channel, command.DataVersion, command.ContentType, command.Publisher, command.CorrelationId, command.Skipped})
+		var frame = make([]byte, 0, len(header) + 1 + len(command.Data))
+		frame = append(append(append(frame, header...), '\n'), command.Data...)
+		if err := m.writeMessage(websocket.BinaryMessage, frame); err != nil {
+			return err
+		}
+	}
+	return writeText()
+}
+
+/**
+* writes responses and subscriber data to socket, and pings the client
+* feed is nil (never selected) until a subscriber is received
+*/
 func (m *WebSocketHandler) writer() {
-	l.If("wswriter process - %s - starting", m.subscriber.id)
-	
-	defer close(m.send);
-	defer close(m.closeListener);
-  defer m.ws.Close()
-  defer l.If("wswriter process - %s - stopped", m.subscriber.id)
+	var subscriberId = "anonymous"
+	var feed chan SubscriberFeedCommand
+	var pingTicker = m.hub.config.Clock.NewTicker(m.hub.config.WsPingPeriod)
+	l.I("wswriter process - starting")
+	defer pingTicker.Stop()
+	defer func() {
+		l.If("wswriter process - %s - stopped", subscriberId)
+	}()
 	
 	for {
 		select {
+			case subscriber := <- m.subscribed:
+				subscriberId = subscriber.id
+				feed = subscriber.feedListener
+				l.If("wswriter process - %s - subscribed", subscriberId)
 			case message := <- m.send:
-				jsonData, _ := json.Marshal(message)
-				l.If("wswriter process - %s - serve json %s", m.subscriber.id, jsonData)
-  			err := websocket.Message.Send(m.ws, string(jsonData))
-    		if err != nil {
-    			l.Ef("wswriter process - %s - error writing to socket: %s", m.subscriber.id, err.Error())
-    		}
-			case command := <- m.subscriber.feedListener:
-				var response = SubscriberResponse{Status: 1, Commands: command.data}
-				jsonData, _ := json.Marshal(response)
-				l.If("wswriter process - %s - serve data: %s", m.subscriber.id, string(jsonData))
-				err := websocket.Message.Send(m.ws, string(jsonData))
-    		if err != nil {
-    			l.Ef("wswriter process - %s - error writing to socket: %s", m.subscriber.id, err.Error())
-    		}
-    	case <- m.closeListener:
-    		l.If("wswriter process - %s - received close command", m.subscriber.id)
-    		return
-    	case <- time.After(30 * time.Second):
-    		l.If("wswriter process - %s - alive", m.subscriber.id)
+				l.If("wswriter process - %s - serve response %d", subscriberId, message.RequestId)
+				err := m.write(message)
+				if err != nil {
+					l.Ef("wswriter process - %s - error writing to socket: %s", subscriberId, err.Error())
+				}
+			case command := <- feed:
+				l.If("wswriter process - %s - serve data: %d commands", subscriberId, len(command.data))
+				err := m.writeFeed(command.data)
+				if err != nil {
+					l.Ef("wswriter process - %s - error writing to socket: %s", subscriberId, err.Error())
+				}
+			case <- pingTicker.C():
+				err := m.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(m.hub.config.WsWriteWait))
+				if err != nil {
+					l.If("wswriter process - %s - error sending ping: %s", subscriberId, err.Error())
+				}
+			case <- m.closeListener:
+				l.If("wswriter process - %s - received close command", subscriberId)
+				return
 		}
 	}
-	
-}
\ No newline at end of file
+}
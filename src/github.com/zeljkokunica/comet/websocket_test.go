@@ -0,0 +1,250 @@
+package comet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+/**
+* hub serving web sockets on a test server, returns ws url
+*/
+func newTestWebSocketServer(t *testing.T, hub *Hub) string {
+	var server = httptest.NewServer(http.HandlerFunc(hub.ServeWebsocket))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+/**
+* sends command over socket and waits for its response
+*/
+func writeTestCommand(ws *websocket.Conn, command WebSocketCommand) (WebSocketResponse, error) {
+	if err := ws.WriteJSON(command); err != nil {
+		return WebSocketResponse{}, err
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var response WebSocketResponse
+		if err := ws.ReadJSON(&response); err != nil {
+			return response, err
+		}
+		if response.RequestId == command.RequestId {
+			return response, nil
+		}
+	}
+}
+
+/**
+* opens socket, subscribes with parameters and waits for subscribe response
+*/
+func subscribeTestSocket(url string, parameters map[string]interface{}) (*websocket.Conn, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := writeTestCommand(ws, WebSocketCommand{RequestId: 1, Command: "subscribe", Parameters: parameters})
+	if err == nil && response.Error != nil {
+		err = fmt.Errorf("subscribe failed: %s", response.Error.Error)
+	}
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+/**
+* waits until hub has no subscribers and goroutines are back to baseline
+*/
+func waitForGoroutines(t *testing.T, hub *Hub, baseline int) {
+	var deadline = time.Now().Add(10 * time.Second)
+	for {
+		var subscribers = len(hub.requestSubscriber(HubSubscriberRequest{command: GetSubscribersStatus}).status)
+		var routines = runtime.NumGoroutine()
+		// a few goroutines of test server may still be finishing
+		if subscribers == 0 && routines <= baseline + 5 {
+			return
+		}
+		if time.Now().After(deadline) {
+			var stack = make([]byte, 1 << 20)
+			stack = stack[:runtime.Stack(stack, true)]
+			t.Fatalf("%d subscribers and %d goroutines left, baseline %d\n%s", subscribers, routines, baseline, stack)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+/**
+* opens and closes thousands of sockets, every connection must release its subscriber and goroutines
+*/
+func TestWebSocketConnectionsReleaseGoroutines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("opens thousands of sockets")
+	}
+	var hub = newTestHub(t)
+	var url = newTestWebSocketServer(t, hub)
+	var baseline = runtime.NumGoroutine()
+	const connections = 3000
+	const parallel = 50
+	var wait sync.WaitGroup
+	var failures = make(chan error, parallel)
+	for worker := 0; worker < parallel; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < connections / parallel; i++ {
+				ws, err := subscribeTestSocket(url, map[string]interface{}{"channels": "sockets"})
+				if err != nil {
+					failures <- err
+					return
+				}
+				ws.Close()
+			}
+		}()
+	}
+	wait.Wait()
+	close(failures)
+	for err := range(failures) {
+		t.Fatal(err)
+	}
+	waitForGoroutines(t, hub, baseline)
+}
+
+/**
+* subscribers deleted while their command queue is full still stop
+*/
+func TestWebSocketSubscribersStopWithFullQueue(t *testing.T) {
+	var hub = newTestHub(t)
+	var url = newTestWebSocketServer(t, hub)
+	var baseline = runtime.NumGoroutine()
+	var sockets = make([]*websocket.Conn, 0)
+	for i := 0; i < 20; i++ {
+		ws, err := subscribeTestSocket(url, map[string]interface{}{"channels": "busy"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sockets = append(sockets, ws)
+	}
+	// subscribers are fed while their sockets close
+	var published = make(chan bool)
+	go func() {
+		defer close(published)
+		for i := 0; i < 200; i++ {
+			hub.addNewDataToChannel(ChannelDataInputCommand{Command: DataUpdate, ChannelName: "busy", Data: fmt.Sprintf("%d", i)})
+		}
+	}()
+	for _, ws := range(sockets) {
+		ws.Close()
+	}
+	<- published
+	waitForGoroutines(t, hub, baseline)
+}
+
+/**
+* id parameter of socket commands is always the subscriber of the socket
+*/
+func TestWebSocketCommandsUseSocketSubscriber(t *testing.T) {
+	var hub = newTestHub(t)
+	var url = newTestWebSocketServer(t, hub)
+	alice, err := subscribeTestSocket(url, map[string]interface{}{"channels": "news", "identity": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	var bob = hub.requestSubscriber(HubSubscriberRequest{command: Subscribe, channels: []string{"news"}, options: SubscriptionOptions{Identity: "bob"}}).subscriber
+	response, err := writeTestCommand(alice, WebSocketCommand{RequestId: 2, Command: "removechannels", Parameters: map[string]interface{}{"id": bob.id, "channels": "news"}})
+	if err != nil || response.Error != nil {
+		t.Fatalf("removechannels failed: %v %v", err, response.Error)
+	}
+	for _, subscriber := range(createHubStatus(hub).Subscribers) {
+		var subscribed = len(subscriber.Channels) == 1 && subscriber.Channels[0] == "news"
+		if subscriber.Identity == "bob" && !subscribed {
+			t.Errorf("bob has channels %v, other socket removed them", subscriber.Channels)
+		}
+		if subscriber.Identity == "alice" && subscribed {
+			t.Errorf("alice still has channels %v", subscriber.Channels)
+		}
+	}
+}
+
+/**
+* bytes that are not valid utf-8 published to binary channel arrive unchanged
+* as base64 data over http json and as raw data after json header in web socket binary frame
+*/
+func TestBinaryChannelRoundTrip(t *testing.T) {
+	var hub = newTestHub(t)
+	var url = newTestWebSocketServer(t, hub)
+	var data = []byte{0xff, 0xfe, 0x00, '\n', 0xc3, 0x28, 'a', 0x80}
+	ws, err := subscribeTestSocket(url, map[string]interface{}{"channels": "image", "mode": SubscriptionDeltas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var subscribe = requestTestHub(hub, "/subscribe?channels=image&mode=deltas", nil)
+	var subscribed struct {
+		SubscriberId string `json:"subscriberId"`
+	}
+	if err = json.Unmarshal(subscribe.Body.Bytes(), &subscribed); err != nil || subscribed.SubscriberId == "" {
+		t.Fatalf("subscribe returned %d %s", subscribe.Code, subscribe.Body.String())
+	}
+	var request = httptest.NewRequest("POST", "/create?channel=image&contentType=image/png", bytes.NewReader(data))
+	request.Header.Set("Content-Type", "application/octet-stream")
+	var recorder = httptest.NewRecorder()
+	hub.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("create returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	var response struct {
+		Commands []struct {
+			Channel string `json:"channel"`
+			Data string `json:"data"`
+			Encoding string `json:"encoding"`
+			ContentType string `json:"contentType"`
+		} `json:"commands"`
+	}
+	// feed may first carry data of private channel of subscriber
+	for len(response.Commands) == 0 || response.Commands[0].Channel != "image" {
+		if len(response.Commands) > 0 {
+			response.Commands = response.Commands[1:]
+			continue
+		}
+		var feed = requestTestHub(hub, "/data?id=" + subscribed.SubscriberId, nil)
+		if err = json.Unmarshal(feed.Body.Bytes(), &response); err != nil || len(response.Commands) == 0 {
+			t.Fatalf("feed returned %s", feed.Body.String())
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response.Commands[0].Data)
+	if err != nil || response.Commands[0].Encoding != "base64" || response.Commands[0].ContentType != "image/png" || !bytes.Equal(decoded, data) {
+		t.Errorf("json feed command %+v, expected base64 of %v", response.Commands[0], data)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		var separator = bytes.IndexByte(message, '\n')
+		var header webSocketBinaryHeader
+		if separator < 0 || json.Unmarshal(message[:separator], &header) != nil {
+			t.Fatalf("binary frame %q has no json header", message)
+		}
+		if header.Command != DataCreate || header.Channel != "image" || header.ContentType != "image/png" || !bytes.Equal(message[separator + 1:], data) {
+			t.Errorf("binary frame header %+v data %v, expected %v", header, message[separator + 1:], data)
+		}
+		return
+	}
+}
@@ -21,7 +21,16 @@ type SubscriberResponseCommand struct {
 	Channel string `json:"channel"`
 	Data string `json:"data"`
 	DataVersion int64 `json:"version"`
+	// versions before this update left out by the server on purpose (filter, own data)
+	Skipped int64 `json:"skipped"`
 }
+/**
+* response to subscribe request
+*/
+type subscribeResponse struct {
+	SubscriberId string `json:"subscriberId"`
+}
+
 /**
 * complete response to client
 */
@@ -41,10 +50,12 @@ type CometClient struct {
 	subscriberId string
 	OnDataFeed chan SubscriberResponseCommand
 	clientCommand chan cometClientCommand
+	// last received version of each channel
+	channelVersions map[string]int64
 }
 
 func NewCometClient(serverIp string, channels []string) CometClient {
-	var client = CometClient{serverIp, channels, "", make (chan SubscriberResponseCommand, 10), make(chan cometClientCommand, 10)}
+	var client = CometClient{serverIp, channels, "", make (chan SubscriberResponseCommand, 10), make(chan cometClientCommand, 10), make(map[string]int64)}
 	go client.cometClientProcess()
 	return client
 } 
@@ -83,8 +94,12 @@ func (c *CometClient) subscribe() {
 			var idBytes []byte
 			idBytes, err = ioutil.ReadAll(resp.Body);
 			resp.Body.Close()	
+			var response subscribeResponse
+			if err == nil {
+				err = json.Unmarshal(idBytes, &response)
+			}
 			if err == nil {
-				id = string(idBytes)
+				id = response.SubscriberId
 				break
 			} else {
 				fmt.Printf("subscribe parse response failed %s", err.Error())
@@ -95,6 +110,7 @@ func (c *CometClient) subscribe() {
 		<-time.After(time.Second)
 	}
 	c.subscriberId = id
+	c.channelVersions = make(map[string]int64)
 	fmt.Printf("\nsubscribed %s", id)
 }
 
@@ -127,6 +143,14 @@ func (c *CometClient) getData() {
 			case 1:
 //				fmt.Printf("\ngot new data %d", len(result.Commands))
 				for i := 0; i < len(result.Commands); i++ {
+					if c.resyncPending(result.Commands[i]) {
+						continue
+					}
+					if c.isGap(result.Commands[i]) {
+						fmt.Printf("\nskipped versions of %s, resyncing", result.Commands[i].Channel)
+						c.resync(result.Commands[i].Channel)
+						continue
+					}
 					c.OnDataFeed <- result.Commands[i]
 				}
 			case -1:
@@ -140,6 +164,48 @@ func (c *CometClient) getData() {
 	}
 }
 
+/**
+* true for updates of a channel waiting for resync (version -1), they are replaced by resync data
+*/
+func (c *CometClient) resyncPending(command SubscriberResponseCommand) bool {
+	lastVersion, found := c.channelVersions[command.Channel]
+	return command.Command == "update" && found && lastVersion < 0
+}
+
+/**
+* true if update skips versions after the last received data of its channel, other than versions the server skipped on purpose
+* channel is marked as waiting for resync, versions of received data are remembered
+*/
+func (c *CometClient) isGap(command SubscriberResponseCommand) bool {
+	switch command.Command {
+		case "update":
+			lastVersion, found := c.channelVersions[command.Channel]
+			if found && command.DataVersion <= lastVersion {
+				return false
+			}
+			if found && command.DataVersion - command.Skipped > lastVersion + 1 {
+				c.channelVersions[command.Channel] = -1
+				return true
+			}
+		case "create", "clear", "resync":
+		default:
+			return false
+	}
+	c.channelVersions[command.Channel] = command.DataVersion
+	return false
+}
+
+/**
+* asks server for fresh channel data, sent as resync command
+*/
+func (c *CometClient) resync(channel string) {
+	resp, err := http.Get("http://" + c.serverIp + "/resync?id=" + c.subscriberId + "&channels=" + channel)
+	if err != nil {
+		fmt.Printf("\nresync failed %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+}
 
 func (c *CometClient) cometClientProcess() {
 	for {
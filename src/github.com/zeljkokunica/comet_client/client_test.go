@@ -0,0 +1,77 @@
+package comet_client
+
+import (
+	"testing"
+)
+
+/**
+* delivered updates of a channel, resync requested on gaps
+*/
+func receiveTestCommands(c *CometClient, commands []SubscriberResponseCommand) ([]int64, int) {
+	var delivered = make([]int64, 0)
+	var resyncs = 0
+	for _, command := range(commands) {
+		if c.resyncPending(command) {
+			continue
+		}
+		if c.isGap(command) {
+			resyncs++
+			continue
+		}
+		delivered = append(delivered, command.DataVersion)
+	}
+	return delivered, resyncs
+}
+
+func TestGapResyncsOnce(t *testing.T) {
+	var client = CometClient{channelVersions: make(map[string]int64)}
+	delivered, resyncs := receiveTestCommands(&client, []SubscriberResponseCommand{
+		{Command: "create", Channel: "a", DataVersion: 1},
+		{Command: "update", Channel: "a", DataVersion: 2},
+		{Command: "update", Channel: "a", DataVersion: 4},
+		{Command: "update", Channel: "a", DataVersion: 5},
+		{Command: "update", Channel: "a", DataVersion: 6},
+		{Command: "resync", Channel: "a", DataVersion: 6},
+		{Command: "update", Channel: "a", DataVersion: 7},
+	})
+	if resyncs != 1 {
+		t.Errorf("%d resyncs, expected 1", resyncs)
+	}
+	var expected = []int64{1, 2, 6, 7}
+	if len(delivered) != len(expected) {
+		t.Fatalf("delivered versions %v, expected %v", delivered, expected)
+	}
+	for i := range(expected) {
+		if delivered[i] != expected[i] {
+			t.Fatalf("delivered versions %v, expected %v", delivered, expected)
+		}
+	}
+}
+
+func TestGapIgnoresOtherChannels(t *testing.T) {
+	var client = CometClient{channelVersions: make(map[string]int64)}
+	_, resyncs := receiveTestCommands(&client, []SubscriberResponseCommand{
+		{Command: "create", Channel: "a", DataVersion: 1},
+		{Command: "update", Channel: "a", DataVersion: 3},
+		{Command: "create", Channel: "b", DataVersion: 1},
+		{Command: "update", Channel: "b", DataVersion: 2},
+	})
+	if resyncs != 1 {
+		t.Errorf("%d resyncs, expected 1", resyncs)
+	}
+}
+
+func TestSkippedVersionsAreNoGap(t *testing.T) {
+	var client = CometClient{channelVersions: make(map[string]int64)}
+	delivered, resyncs := receiveTestCommands(&client, []SubscriberResponseCommand{
+		{Command: "create", Channel: "a", DataVersion: 1},
+		{Command: "update", Channel: "a", DataVersion: 4, Skipped: 2},
+		{Command: "update", Channel: "a", DataVersion: 7, Skipped: 1},
+	})
+	if resyncs != 1 {
+		t.Errorf("%d resyncs, expected 1 for version dropped after 4", resyncs)
+	}
+	if len(delivered) != 2 || delivered[1] != 4 {
+		t.Errorf("delivered versions %v, expected 1 and 4", delivered)
+	}
+}
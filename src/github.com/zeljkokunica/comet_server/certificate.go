@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+	"github.com/zeljkokunica/l"
+)
+
+var certificateCheckPeriod = 10 * time.Second
+
+/**
+* holds tls certificate loaded from cert and key files, and reloads it when any of the files changes
+*/
+type CertificateReloader struct {
+	certFile string
+	keyFile string
+	lock sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime time.Time
+}
+
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	var reloader = &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	go reloader.watchProcess()
+	return reloader, nil
+}
+
+func (r *CertificateReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.certificate = &certificate
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	r.lock.Unlock()
+	l.If("certificate loaded from %s", r.certFile)
+	return nil
+}
+
+/**
+* true if cert or key file was modified since last load
+*/
+func (r *CertificateReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+/**
+* periodically checks certificate files and reloads them on change
+* failed reload keeps previous certificate
+*/
+func (r *CertificateReloader) watchProcess() {
+	l.I("certificate process - start")
+	for {
+		time.Sleep(certificateCheckPeriod)
+		if r.changed() {
+			if err := r.reload(); err != nil {
+				l.Ef("certificate process - reload failed, keeping previous certificate: %s", err.Error())
+			}
+		}
+	}
+}
+
+/**
+* tls.Config GetCertificate callback
+*/
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.certificate, nil
+}
+
+/**
+* tls config serving reloadable certificate, with HTTP/2 negotiated over ALPN
+*/
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos: []string{"h2", "http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	}
+}
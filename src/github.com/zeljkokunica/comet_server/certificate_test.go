@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/**
+* writes self-signed certificate for 127.0.0.1 with common name to cert and key files
+*/
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// file systems with coarse modification times would hide quick rewrites
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+/**
+* starts https server with certificates, like httpServerProcess does
+*/
+func startTestServer(t *testing.T, certificates *CertificateReloader) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	server.TLSConfig = certificates.TLSConfig()
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+/**
+* common name of certificate served and protocol of response
+*/
+func requestTestServer(t *testing.T, url string) (string, string) {
+	var client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	response, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	return response.TLS.PeerCertificates[0].Subject.CommonName, string(body)
+}
+
+func TestMain(m *testing.M) {
+	// reload tests wait for certificate process
+	certificateCheckPeriod = 10 * time.Millisecond
+	var err error
+	if testDataDir, err = ioutil.TempDir("", "comet_server"); err != nil {
+		panic(err)
+	}
+	var result = m.Run()
+	os.RemoveAll(testDataDir)
+	os.Exit(result)
+}
+
+func TestCertificateServesHttp2(t *testing.T) {
+	var dir = t.TempDir()
+	var certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first", time.Now())
+	certificates, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName, proto := requestTestServer(t, startTestServer(t, certificates))
+	if commonName != "first" {
+		t.Errorf("served certificate %s, expected first", commonName)
+	}
+	if proto != "HTTP/2.0" {
+		t.Errorf("protocol %s, expected HTTP/2.0", proto)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	var dir = t.TempDir()
+	var certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+	certificates, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var url = startTestServer(t, certificates)
+	writeTestCertificate(t, certFile, keyFile, "second", time.Now())
+	var deadline = time.Now().Add(2 * time.Second)
+	for {
+		commonName, _ := requestTestServer(t, url)
+		if commonName == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded, still serving %s", commonName)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// broken files keep previous certificate
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	var later = time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	time.Sleep(100 * time.Millisecond)
+	if commonName, _ := requestTestServer(t, url); commonName != "second" {
+		t.Errorf("served certificate %s after failed reload, expected second", commonName)
+	}
+}
+
+func TestCertificateMissingFiles(t *testing.T) {
+	var dir = t.TempDir()
+	if _, err := NewCertificateReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("expected error for missing certificate files")
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/BurntSushi/toml"
+	"github.com/zeljkokunica/comet"
+	"github.com/zeljkokunica/l"
+	"gopkg.in/yaml.v3"
+)
+
+/**
+* duration written as "30s", "5m"... in config files and environment
+*/
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", string(text))
+	}
+	d.Duration = duration
+	return nil
+}
+
+type ListenConfig struct {
+	Ip string `json:"ip" yaml:"ip" toml:"ip"`
+	Port int `json:"port" yaml:"port" toml:"port"`
+	// plain http server redirecting to https, 0 - disabled
+	RedirectPort int `json:"redirectPort" yaml:"redirectPort" toml:"redirectPort"`
+	TlsCert string `json:"tlsCert" yaml:"tlsCert" toml:"tlsCert"`
+	TlsKey string `json:"tlsKey" yaml:"tlsKey" toml:"tlsKey"`
+}
+
+type TimeoutsConfig struct {
+	LongPoll Duration `json:"longPoll" yaml:"longPoll" toml:"longPoll"`
+	Feed Duration `json:"feed" yaml:"feed" toml:"feed"`
+	SubscriberKeepAlive Duration `json:"subscriberKeepAlive" yaml:"subscriberKeepAlive" toml:"subscriberKeepAlive"`
+	Request Duration `json:"request" yaml:"request" toml:"request"`
+	MaxRequest Duration `json:"maxRequest" yaml:"maxRequest" toml:"maxRequest"`
+	Backend Duration `json:"backend" yaml:"backend" toml:"backend"`
+	QueueAck Duration `json:"queueAck" yaml:"queueAck" toml:"queueAck"`
+	MaxScheduleDelay Duration `json:"maxScheduleDelay" yaml:"maxScheduleDelay" toml:"maxScheduleDelay"`
+	WsPing Duration `json:"wsPing" yaml:"wsPing" toml:"wsPing"`
+	WsPongWait Duration `json:"wsPongWait" yaml:"wsPongWait" toml:"wsPongWait"`
+	WsWrite Duration `json:"wsWrite" yaml:"wsWrite" toml:"wsWrite"`
+	StreamHeartbeat Duration `json:"streamHeartbeat" yaml:"streamHeartbeat" toml:"streamHeartbeat"`
+	StreamMaxDuration Duration `json:"streamMaxDuration" yaml:"streamMaxDuration" toml:"streamMaxDuration"`
+}
+
+type RateLimitsConfig struct {
+	PerAddress comet.RateLimit `json:"perAddress" yaml:"perAddress" toml:"perAddress"`
+	PerSubscriber comet.RateLimit `json:"perSubscriber" yaml:"perSubscriber" toml:"perSubscriber"`
+	PerChannel comet.RateLimit `json:"perChannel" yaml:"perChannel" toml:"perChannel"`
+}
+
+/**
+* channel updates kept, older updates are folded into channel data - 0 keeps all
+*/
+type RetentionConfig struct {
+	MaxUpdates int `json:"maxUpdates" yaml:"maxUpdates" toml:"maxUpdates"`
+	MaxAge Duration `json:"maxAge" yaml:"maxAge" toml:"maxAge"`
+}
+
+/**
+* sizes enforced by the hub - larger data, more channels or longer names are rejected
+*/
+type LimitsConfig struct {
+	MaxDataSize int `json:"maxDataSize" yaml:"maxDataSize" toml:"maxDataSize"`
+	MaxChannels int `json:"maxChannels" yaml:"maxChannels" toml:"maxChannels"`
+	// including subscriber's private channel
+	MaxChannelsPerSubscriber int `json:"maxChannelsPerSubscriber" yaml:"maxChannelsPerSubscriber" toml:"maxChannelsPerSubscriber"`
+	MaxChannelNameLength int `json:"maxChannelNameLength" yaml:"maxChannelNameLength" toml:"maxChannelNameLength"`
+}
+
+type CorsConfig struct {
+	// "*" allows every origin
+	AllowedOrigins []string `json:"allowedOrigins" yaml:"allowedOrigins" toml:"allowedOrigins"`
+}
+
+/**
+* settings of comet_server
+* defaults are overridden by config file, then by COMET_* environment variables, then by command line flags
+*/
+type ServerConfig struct {
+	Listen ListenConfig `json:"listen" yaml:"listen" toml:"listen"`
+	DataDir string `json:"dataDir" yaml:"dataDir" toml:"dataDir"`
+	WebRoot string `json:"webRoot" yaml:"webRoot" toml:"webRoot"`
+	RestoreData bool `json:"restoreData" yaml:"restoreData" toml:"restoreData"`
+	// json file with backend routes
+	Routes string `json:"routes" yaml:"routes" toml:"routes"`
+	SubscriberQueueSize int `json:"subscriberQueueSize" yaml:"subscriberQueueSize" toml:"subscriberQueueSize"`
+	ListenerQueueSize int `json:"listenerQueueSize" yaml:"listenerQueueSize" toml:"listenerQueueSize"`
+	Timeouts TimeoutsConfig `json:"timeouts" yaml:"timeouts" toml:"timeouts"`
+	Limits LimitsConfig `json:"limits" yaml:"limits" toml:"limits"`
+	RateLimits RateLimitsConfig `json:"rateLimits" yaml:"rateLimits" toml:"rateLimits"`
+	Retention RetentionConfig `json:"retention" yaml:"retention" toml:"retention"`
+	Auth comet.AuthConfig `json:"auth" yaml:"auth" toml:"auth"`
+	Cors CorsConfig `json:"cors" yaml:"cors" toml:"cors"`
+	// debug, info, warn or error
+	LogLevel string `json:"logLevel" yaml:"logLevel" toml:"logLevel"`
+}
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+func DefaultServerConfig() ServerConfig {
+	var hubConfig = comet.DefaultHubConfig()
+	perAddress, perSubscriber, perChannel := comet.DefaultRateLimits()
+	return ServerConfig{
+		Listen: ListenConfig{Ip: "0.0.0.0", Port: 8080},
+		DataDir: hubConfig.DataDir,
+		WebRoot: hubConfig.WebRoot,
+		RestoreData: true,
+		SubscriberQueueSize: hubConfig.SubscriberQueueSize,
+		ListenerQueueSize: hubConfig.ListenerQueueSize,
+		Timeouts: TimeoutsConfig{
+			LongPoll: Duration{hubConfig.LongPollTimeout},
+			Feed: Duration{hubConfig.FeedTimeout},
+			SubscriberKeepAlive: Duration{hubConfig.SubscriberKeepAlive},
+			Request: Duration{hubConfig.RequestTimeout},
+			MaxRequest: Duration{hubConfig.MaxRequestTimeout},
+			Backend: Duration{hubConfig.BackendTimeout},
+			QueueAck: Duration{hubConfig.QueueAckTimeout},
+			MaxScheduleDelay: Duration{hubConfig.MaxScheduleDelay},
+			WsPing: Duration{hubConfig.WsPingPeriod},
+			WsPongWait: Duration{hubConfig.WsPongWait},
+			WsWrite: Duration{hubConfig.WsWriteWait},
+			StreamHeartbeat: Duration{hubConfig.StreamHeartbeatPeriod},
+			StreamMaxDuration: Duration{hubConfig.StreamMaxDuration},
+		},
+		Limits: LimitsConfig{
+			MaxDataSize: hubConfig.MaxDataSize,
+			MaxChannels: hubConfig.MaxChannels,
+			MaxChannelsPerSubscriber: hubConfig.MaxChannelsPerSubscriber,
+			MaxChannelNameLength: hubConfig.MaxChannelNameLength,
+		},
+		RateLimits: RateLimitsConfig{PerAddress: perAddress, PerSubscriber: perSubscriber, PerChannel: perChannel},
+		Cors: CorsConfig{AllowedOrigins: []string{"*"}},
+		LogLevel: "debug",
+	}
+}
+
+/**
+* reads config file over config, format is chosen by extension (.yaml, .yml, .json or .toml)
+* unknown settings are errors
+*/
+func (c *ServerConfig) loadFile(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml":
+			var decoder = yaml.NewDecoder(bytes.NewReader(content))
+			decoder.KnownFields(true)
+			err = decoder.Decode(c)
+			if err != nil && err.Error() == "EOF" {
+				// empty file
+				err = nil
+			}
+		case ".json":
+			var decoder = json.NewDecoder(bytes.NewReader(content))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(c)
+		case ".toml":
+			var metadata toml.MetaData
+			metadata, err = toml.Decode(string(content), c)
+			if err == nil && len(metadata.Undecoded()) > 0 {
+				err = fmt.Errorf("unknown setting %s", metadata.Undecoded()[0].String())
+			}
+		default:
+			return fmt.Errorf("unsupported config file format %s - use .yaml, .json or .toml", filepath.Ext(file))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return nil
+}
+
+/**
+* environment variables and settings they override
+*/
+func (c *ServerConfig) environment() []struct{ name string; value interface{} } {
+	return []struct{ name string; value interface{} }{
+		{"COMET_IP", &c.Listen.Ip},
+		{"COMET_PORT", &c.Listen.Port},
+		{"COMET_REDIRECT_PORT", &c.Listen.RedirectPort},
+		{"COMET_TLS_CERT", &c.Listen.TlsCert},
+		{"COMET_TLS_KEY", &c.Listen.TlsKey},
+		{"COMET_DATA_DIR", &c.DataDir},
+		{"COMET_WEB_ROOT", &c.WebRoot},
+		{"COMET_RESTORE_DATA", &c.RestoreData},
+		{"COMET_ROUTES", &c.Routes},
+		{"COMET_SUBSCRIBER_QUEUE_SIZE", &c.SubscriberQueueSize},
+		{"COMET_LISTENER_QUEUE_SIZE", &c.ListenerQueueSize},
+		{"COMET_LONG_POLL_TIMEOUT", &c.Timeouts.LongPoll},
+		{"COMET_FEED_TIMEOUT", &c.Timeouts.Feed},
+		{"COMET_SUBSCRIBER_KEEP_ALIVE", &c.Timeouts.SubscriberKeepAlive},
+		{"COMET_REQUEST_TIMEOUT", &c.Timeouts.Request},
+		{"COMET_MAX_REQUEST_TIMEOUT", &c.Timeouts.MaxRequest},
+		{"COMET_BACKEND_TIMEOUT", &c.Timeouts.Backend},
+		{"COMET_QUEUE_ACK_TIMEOUT", &c.Timeouts.QueueAck},
+		{"COMET_MAX_SCHEDULE_DELAY", &c.Timeouts.MaxScheduleDelay},
+		{"COMET_WS_PING", &c.Timeouts.WsPing},
+		{"COMET_WS_PONG_WAIT", &c.Timeouts.WsPongWait},
+		{"COMET_WS_WRITE", &c.Timeouts.WsWrite},
+		{"COMET_STREAM_HEARTBEAT", &c.Timeouts.StreamHeartbeat},
+		{"COMET_STREAM_MAX_DURATION", &c.Timeouts.StreamMaxDuration},
+		{"COMET_MAX_DATA_SIZE", &c.Limits.MaxDataSize},
+		{"COMET_MAX_CHANNELS", &c.Limits.MaxChannels},
+		{"COMET_MAX_CHANNELS_PER_SUBSCRIBER", &c.Limits.MaxChannelsPerSubscriber},
+		{"COMET_MAX_CHANNEL_NAME_LENGTH", &c.Limits.MaxChannelNameLength},
+		{"COMET_SUBSCRIBE_KEYS", &c.Auth.SubscribeKeys},
+		{"COMET_PUBLISH_KEYS", &c.Auth.PublishKeys},
+		{"COMET_ADMIN_KEYS", &c.Auth.AdminKeys},
+		{"COMET_RETENTION_MAX_UPDATES", &c.Retention.MaxUpdates},
+		{"COMET_RETENTION_MAX_AGE", &c.Retention.MaxAge},
+		{"COMET_ALLOWED_ORIGINS", &c.Cors.AllowedOrigins},
+		{"COMET_LOG_LEVEL", &c.LogLevel},
+	}
+}
+
+/**
+* applies COMET_* environment variables, lists are comma separated
+*/
+func (c *ServerConfig) loadEnvironment(lookup func(string) (string, bool)) []string {
+	var errors = make([]string, 0)
+	for _, variable := range(c.environment()) {
+		text, found := lookup(variable.name)
+		if !found {
+			continue
+		}
+		var err error
+		switch value := variable.value.(type) {
+			case *string:
+				*value = text
+			case *int:
+				*value, err = strconv.Atoi(text)
+			case *bool:
+				*value, err = strconv.ParseBool(text)
+			case *Duration:
+				err = value.UnmarshalText([]byte(text))
+			case *[]string:
+				*value = make([]string, 0)
+				for _, item := range(strings.Split(text, ",")) {
+					if item = strings.TrimSpace(item); item != "" {
+						*value = append(*value, item)
+					}
+				}
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: invalid value %q", variable.name, text))
+		}
+	}
+	return errors
+}
+
+/**
+* all problems of config, empty if config is valid
+*/
+func (c *ServerConfig) validate() []string {
+	var errors = make([]string, 0)
+	var check = func(valid bool, format string, v ...interface{}) {
+		if !valid {
+			errors = append(errors, fmt.Sprintf(format, v...))
+		}
+	}
+	check(c.Listen.Port > 0 && c.Listen.Port < 65536, "listen.port must be between 1 and 65535")
+	check(c.Listen.RedirectPort >= 0 && c.Listen.RedirectPort < 65536, "listen.redirectPort must be between 0 and 65535")
+	check((c.Listen.TlsCert == "") == (c.Listen.TlsKey == ""), "listen.tlsCert and listen.tlsKey must be set together")
+	check(c.Listen.RedirectPort == 0 || c.Listen.TlsCert != "", "listen.redirectPort requires tls")
+	check(c.Listen.RedirectPort == 0 || c.Listen.RedirectPort != c.Listen.Port, "listen.redirectPort must differ from listen.port")
+	check(c.DataDir != "", "dataDir must be set")
+	check(c.WebRoot != "", "webRoot must be set")
+	check(c.SubscriberQueueSize > 0, "subscriberQueueSize must be positive")
+	check(c.ListenerQueueSize > 0, "listenerQueueSize must be positive")
+	for _, timeout := range([]struct{ name string; value Duration }{
+		{"longPoll", c.Timeouts.LongPoll},
+		{"feed", c.Timeouts.Feed},
+		{"subscriberKeepAlive", c.Timeouts.SubscriberKeepAlive},
+		{"request", c.Timeouts.Request},
+		{"maxRequest", c.Timeouts.MaxRequest},
+		{"backend", c.Timeouts.Backend},
+		{"queueAck", c.Timeouts.QueueAck},
+		{"maxScheduleDelay", c.Timeouts.MaxScheduleDelay},
+		{"wsPing", c.Timeouts.WsPing},
+		{"wsPongWait", c.Timeouts.WsPongWait},
+		{"wsWrite", c.Timeouts.WsWrite},
+		{"streamHeartbeat", c.Timeouts.StreamHeartbeat},
+		{"streamMaxDuration", c.Timeouts.StreamMaxDuration},
+	}) {
+		check(timeout.value.Duration > 0, "timeouts.%s must be positive", timeout.name)
+	}
+	check(c.Timeouts.MaxRequest.Duration >= c.Timeouts.Request.Duration, "timeouts.maxRequest must not be shorter than timeouts.request")
+	check(c.Timeouts.WsPongWait.Duration > c.Timeouts.WsPing.Duration, "timeouts.wsPongWait must be longer than timeouts.wsPing")
+	for _, limit := range([]struct{ name string; value int }{
+		{"maxDataSize", c.Limits.MaxDataSize},
+		{"maxChannels", c.Limits.MaxChannels},
+		{"maxChannelsPerSubscriber", c.Limits.MaxChannelsPerSubscriber},
+		{"maxChannelNameLength", c.Limits.MaxChannelNameLength},
+	}) {
+		check(limit.value > 0, "limits.%s must be positive", limit.name)
+	}
+	// subscriber always has its private channel
+	check(c.Limits.MaxChannelsPerSubscriber <= 0 || c.Limits.MaxChannelsPerSubscriber >= 2, "limits.maxChannelsPerSubscriber must be at least 2")
+	for _, limit := range([]struct{ name string; value comet.RateLimit }{
+		{"perAddress", c.RateLimits.PerAddress},
+		{"perSubscriber", c.RateLimits.PerSubscriber},
+		{"perChannel", c.RateLimits.PerChannel},
+	}) {
+		check(limit.value.Rate >= 0, "rateLimits.%s.rate must not be negative", limit.name)
+		check(limit.value.Rate == 0 || limit.value.Burst >= 1, "rateLimits.%s.burst must be at least 1", limit.name)
+	}
+	check(c.Retention.MaxUpdates >= 0, "retention.maxUpdates must not be negative")
+	check(c.Retention.MaxAge.Duration >= 0, "retention.maxAge must not be negative")
+	for _, keys := range([]struct{ name string; value []string }{{"subscribeKeys", c.Auth.SubscribeKeys}, {"publishKeys", c.Auth.PublishKeys}, {"adminKeys", c.Auth.AdminKeys}}) {
+		for _, key := range(keys.value) {
+			check(strings.TrimSpace(key) != "", "auth.%s must not contain empty keys", keys.name)
+		}
+	}
+	for _, origin := range(c.Cors.AllowedOrigins) {
+		check(origin == "*" || strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"), "cors.allowedOrigins: invalid origin %q", origin)
+	}
+	_, found := logLevels[strings.ToLower(c.LogLevel)]
+	check(found, "logLevel must be debug, info, warn or error")
+	return errors
+}
+
+func (c ServerConfig) hubConfig() comet.HubConfig {
+	var config = comet.DefaultHubConfig()
+	config.DataDir = c.DataDir
+	config.WebRoot = c.WebRoot
+	config.SkipRestore = !c.RestoreData
+	config.SubscriberQueueSize = c.SubscriberQueueSize
+	config.ListenerQueueSize = c.ListenerQueueSize
+	config.LongPollTimeout = c.Timeouts.LongPoll.Duration
+	config.FeedTimeout = c.Timeouts.Feed.Duration
+	config.SubscriberKeepAlive = c.Timeouts.SubscriberKeepAlive.Duration
+	config.RequestTimeout = c.Timeouts.Request.Duration
+	config.MaxRequestTimeout = c.Timeouts.MaxRequest.Duration
+	config.BackendTimeout = c.Timeouts.Backend.Duration
+	config.QueueAckTimeout = c.Timeouts.QueueAck.Duration
+	config.MaxScheduleDelay = c.Timeouts.MaxScheduleDelay.Duration
+	config.WsPingPeriod = c.Timeouts.WsPing.Duration
+	config.WsPongWait = c.Timeouts.WsPongWait.Duration
+	config.WsWriteWait = c.Timeouts.WsWrite.Duration
+	config.StreamHeartbeatPeriod = c.Timeouts.StreamHeartbeat.Duration
+	config.StreamMaxDuration = c.Timeouts.StreamMaxDuration.Duration
+	config.MaxDataSize = c.Limits.MaxDataSize
+	config.MaxChannels = c.Limits.MaxChannels
+	config.MaxChannelsPerSubscriber = c.Limits.MaxChannelsPerSubscriber
+	config.MaxChannelNameLength = c.Limits.MaxChannelNameLength
+	return config
+}
+
+/**
+* settings that can be changed on a running hub
+*/
+func (c ServerConfig) applyLive(hub *comet.Hub) {
+	l.SetMinLogLevel(logLevels[strings.ToLower(c.LogLevel)])
+	hub.SetRateLimits(c.RateLimits.PerAddress, c.RateLimits.PerSubscriber, c.RateLimits.PerChannel)
+	hub.SetRetention(comet.ChannelRetention{MaxUpdates: c.Retention.MaxUpdates, MaxAge: c.Retention.MaxAge.Duration})
+	hub.SetAuth(c.Auth)
+	hub.SetAllowedOrigins(c.Cors.AllowedOrigins)
+}
+
+/**
+* config as yaml, with auth keys hidden
+*/
+func (c ServerConfig) print() string {
+	var redact = func(keys []string) []string {
+		var result = make([]string, len(keys))
+		for i := range(keys) {
+			result[i] = "********"
+		}
+		return result
+	}
+	c.Auth = comet.AuthConfig{SubscribeKeys: redact(c.Auth.SubscribeKeys), PublishKeys: redact(c.Auth.PublishKeys), AdminKeys: redact(c.Auth.AdminKeys)}
+	var content bytes.Buffer
+	var encoder = yaml.NewEncoder(&content)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err.Error()
+	}
+	return content.String()
+}
+
+/**
+* defaults, config file, environment and command line flags set by user
+*/
+func loadServerConfig(file string, flagsSet map[string]bool) (ServerConfig, []string) {
+	var config = DefaultServerConfig()
+	if file == "" {
+		file = os.Getenv("COMET_CONFIG")
+	}
+	if file != "" {
+		if err := config.loadFile(file); err != nil {
+			return config, []string{err.Error()}
+		}
+	}
+	var errors = config.loadEnvironment(os.LookupEnv)
+	for _, option := range([]struct{ flag string; apply func() }{
+		{"ip", func() { config.Listen.Ip = *ip }},
+		{"port", func() { config.Listen.Port = *port }},
+		{"redirect-port", func() { config.Listen.RedirectPort = *redirectPort }},
+		{"tls-cert", func() { config.Listen.TlsCert = *tlsCert }},
+		{"tls-key", func() { config.Listen.TlsKey = *tlsKey }},
+		{"routes", func() { config.Routes = *routesFile }},
+		{"data-dir", func() { config.DataDir = *dataDir }},
+		{"web-root", func() { config.WebRoot = *webRoot }},
+	}) {
+		if flagsSet[option.flag] {
+			option.apply()
+		}
+	}
+	return config, append(errors, config.validate()...)
+}
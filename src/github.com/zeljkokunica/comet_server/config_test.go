@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"github.com/zeljkokunica/comet"
+)
+
+var testDataDir string
+
+func writeTestConfig(t *testing.T, name string, content string) string {
+	var file = filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	for _, check := range([]struct {
+		name string
+		content string
+	}{
+		{"config.yaml", "listen: {port: 9000}\ntimeouts: {feed: 45s}\nlimits: {maxChannels: 50}\nauth: {publishKeys: [secret]}\n"},
+		{"config.yml", "listen:\n  port: 9000\ntimeouts:\n  feed: 45s\nlimits:\n  maxChannels: 50\nauth:\n  publishKeys: [secret]\n"},
+		{"config.json", `{"listen": {"port": 9000}, "timeouts": {"feed": "45s"}, "limits": {"maxChannels": 50}, "auth": {"publishKeys": ["secret"]}}`},
+		{"config.toml", "[listen]\nport = 9000\n[timeouts]\nfeed = \"45s\"\n[limits]\nmaxChannels = 50\n[auth]\npublishKeys = [\"secret\"]\n"},
+	}) {
+		var config = DefaultServerConfig()
+		if err := config.loadFile(writeTestConfig(t, check.name, check.content)); err != nil {
+			t.Errorf("%s: %s", check.name, err.Error())
+			continue
+		}
+		if config.Listen.Port != 9000 || config.Timeouts.Feed.Duration != 45 * time.Second || config.Limits.MaxChannels != 50 || !reflect.DeepEqual(config.Auth.PublishKeys, []string{"secret"}) {
+			t.Errorf("%s: loaded %+v", check.name, config)
+		}
+		// settings missing in file keep defaults
+		if config.Listen.Ip != "0.0.0.0" || config.Limits.MaxDataSize != DefaultServerConfig().Limits.MaxDataSize {
+			t.Errorf("%s: defaults changed - ip %s, maxDataSize %d", check.name, config.Listen.Ip, config.Limits.MaxDataSize)
+		}
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, check := range([]struct {
+		name string
+		content string
+	}{
+		{"config.yaml", "listen: {prot: 9000}\n"},
+		{"config.json", `{"listen": {"prot": 9000}}`},
+		{"config.toml", "[listen]\nprot = 9000\n"},
+		{"config.yaml", "timeouts: {feed: soon}\n"},
+		{"config.json", `{"listen": {"port": "9000"}}`},
+		{"config.ini", "port = 9000\n"},
+	}) {
+		var config = DefaultServerConfig()
+		if err := config.loadFile(writeTestConfig(t, check.name, check.content)); err == nil {
+			t.Errorf("%s %q loaded without error", check.name, check.content)
+		}
+	}
+	var config = DefaultServerConfig()
+	if err := config.loadFile(writeTestConfig(t, "empty.yaml", "")); err != nil {
+		t.Errorf("empty yaml: %s", err.Error())
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	var variables = map[string]string{
+		"COMET_PORT": "9100",
+		"COMET_RESTORE_DATA": "false",
+		"COMET_FEED_TIMEOUT": "1m",
+		"COMET_PUBLISH_KEYS": "first, second,,",
+		"COMET_MAX_DATA_SIZE": "1024",
+		"COMET_LOG_LEVEL": "warn",
+	}
+	var lookup = func(name string) (string, bool) {
+		value, found := variables[name]
+		return value, found
+	}
+	var config = DefaultServerConfig()
+	if errors := config.loadEnvironment(lookup); len(errors) != 0 {
+		t.Fatalf("environment errors %v", errors)
+	}
+	if config.Listen.Port != 9100 || config.RestoreData || config.Timeouts.Feed.Duration != time.Minute || config.Limits.MaxDataSize != 1024 || config.LogLevel != "warn" {
+		t.Errorf("environment loaded %+v", config)
+	}
+	if !reflect.DeepEqual(config.Auth.PublishKeys, []string{"first", "second"}) {
+		t.Errorf("publish keys %v, expected [first second]", config.Auth.PublishKeys)
+	}
+	variables = map[string]string{"COMET_PORT": "http", "COMET_RESTORE_DATA": "maybe", "COMET_FEED_TIMEOUT": "30"}
+	if errors := config.loadEnvironment(lookup); len(errors) != 3 {
+		t.Errorf("invalid environment reported %v, expected 3 errors", errors)
+	}
+}
+
+/**
+* config file is overridden by environment, environment by command line flags
+*/
+func TestConfigPrecedence(t *testing.T) {
+	var file = writeTestConfig(t, "config.yaml", "listen: {port: 9000}\ndataDir: from-file\n")
+	var previousPort, previousDataDir = *port, *dataDir
+	defer func() { *port, *dataDir = previousPort, previousDataDir }()
+	*port = 9200
+	*dataDir = "from-flag"
+	// restored after test, cases set and unset it
+	t.Setenv("COMET_PORT", "")
+	for _, check := range([]struct {
+		environment string
+		flagsSet map[string]bool
+		port int
+		dataDir string
+	}{
+		{"", map[string]bool{}, 9000, "from-file"},
+		{"9100", map[string]bool{}, 9100, "from-file"},
+		{"9100", map[string]bool{"port": true}, 9200, "from-file"},
+		{"", map[string]bool{"data-dir": true}, 9000, "from-flag"},
+	}) {
+		if check.environment != "" {
+			os.Setenv("COMET_PORT", check.environment)
+		} else {
+			os.Unsetenv("COMET_PORT")
+		}
+		config, errors := loadServerConfig(file, check.flagsSet)
+		if len(errors) != 0 {
+			t.Errorf("%v: errors %v", check, errors)
+			continue
+		}
+		if config.Listen.Port != check.port || config.DataDir != check.dataDir {
+			t.Errorf("%v: port %d, dataDir %s", check, config.Listen.Port, config.DataDir)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	var defaults = DefaultServerConfig()
+	if errors := defaults.validate(); len(errors) != 0 {
+		t.Fatalf("default config invalid: %v", errors)
+	}
+	for _, check := range([]struct {
+		change func(c *ServerConfig)
+		error string
+	}{
+		{func(c *ServerConfig) { c.Listen.Port = 0 }, "listen.port"},
+		{func(c *ServerConfig) { c.Listen.TlsCert = "cert.pem" }, "listen.tlsCert and listen.tlsKey"},
+		{func(c *ServerConfig) { c.Listen.RedirectPort = 8081 }, "listen.redirectPort requires tls"},
+		{func(c *ServerConfig) { c.Timeouts.Feed.Duration = 0 }, "timeouts.feed"},
+		{func(c *ServerConfig) { c.Timeouts.MaxRequest.Duration = time.Second }, "timeouts.maxRequest"},
+		{func(c *ServerConfig) { c.Timeouts.WsPongWait.Duration = time.Second }, "timeouts.wsPongWait"},
+		{func(c *ServerConfig) { c.Limits.MaxDataSize = 0 }, "limits.maxDataSize"},
+		{func(c *ServerConfig) { c.Limits.MaxChannelsPerSubscriber = 1 }, "limits.maxChannelsPerSubscriber"},
+		{func(c *ServerConfig) { c.RateLimits.PerAddress = comet.RateLimit{Rate: 10} }, "rateLimits.perAddress.burst"},
+		{func(c *ServerConfig) { c.Retention.MaxUpdates = -1 }, "retention.maxUpdates"},
+		{func(c *ServerConfig) { c.Auth.AdminKeys = []string{" "} }, "auth.adminKeys"},
+		{func(c *ServerConfig) { c.Cors.AllowedOrigins = []string{"app.example"} }, "cors.allowedOrigins"},
+		{func(c *ServerConfig) { c.LogLevel = "verbose" }, "logLevel"},
+	}) {
+		var config = DefaultServerConfig()
+		check.change(&config)
+		var errors = config.validate()
+		if len(errors) != 1 || !strings.Contains(errors[0], check.error) {
+			t.Errorf("validation returned %v, expected error about %s", errors, check.error)
+		}
+	}
+}
+
+/**
+* live settings are applied to running hub
+*/
+func TestConfigApplyLive(t *testing.T) {
+	// hub keeps running after the test, its data is removed in TestMain
+	dataDir, err := ioutil.TempDir(testDataDir, "hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hub = comet.NewHub(comet.HubConfig{DataDir: dataDir, SkipRestore: true})
+	var config = DefaultServerConfig()
+	config.Auth.AdminKeys = []string{"admin"}
+	config.Cors.AllowedOrigins = []string{"https://app.example"}
+	config.applyLive(hub)
+	var request = httptest.NewRequest("GET", "/reload", nil)
+	request.Header.Set("Origin", "https://evil.example")
+	var recorder = httptest.NewRecorder()
+	hub.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("reload without admin key returned %d, expected 401", recorder.Code)
+	}
+	if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("origin %s allowed, expected only https://app.example", origin)
+	}
+}
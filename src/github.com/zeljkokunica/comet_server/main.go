@@ -1,30 +1,100 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"github.com/zeljkokunica/l"
 	"github.com/zeljkokunica/comet"
-	"code.google.com/p/go.net/websocket"
 	"flag"
 	"fmt"
+	"strconv"
 )
 
+var ip = flag.String("ip", "0.0.0.0", "ip address to listen on")
+var port = flag.Int("port", 8080, "port to listen on")
+var tlsCert = flag.String("tls-cert", "", "tls certificate file - enables https, wss and HTTP/2")
+var tlsKey = flag.String("tls-key", "", "tls private key file")
+var redirectPort = flag.Int("redirect-port", 0, "port for plain http server redirecting to https (0 - disabled)")
+var routesFile = flag.String("routes", "", "json file with backend routes - commands proxied to http upstreams")
+var dataDir = flag.String("data-dir", "data", "directory of saved channels and scheduled publishes")
+var webRoot = flag.String("web-root", "web", "directory of files served for unknown commands")
+var configFile = flag.String("config", "", "yaml, json or toml config file (default $COMET_CONFIG)")
+var printConfig = flag.Bool("print-config", false, "print effective config and exit")
 
-func httpServerProcess(hub *comet.Hub, restartListener chan string) {
-	var ip = flag.String("ip", "0.0.0.0", "ip address to listen on")
-	var port = flag.Int("port", 8080, "port to listen on")
-	flag.Parse()
-	var addr = fmt.Sprintf("%s:%d", *ip, *port);
+var config ServerConfig
+
+/**
+* reads backend routes - json array of comet.BackendRoute
+*/
+func loadBackendRoutes(hub *comet.Hub, file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var routes []comet.BackendRoute
+	if err = json.Unmarshal(content, &routes); err != nil {
+		return err
+	}
+	l.If("loaded %d backend routes from %s", len(routes), file)
+	return hub.SetBackendRoutes(routes)
+}
+
+func httpServerProcess(hub *comet.Hub, certificates *CertificateReloader, restartListener chan string) {
+	var addr = fmt.Sprintf("%s:%d", config.Listen.Ip, config.Listen.Port);
 	l.If("listening on %s", addr)
-	http.HandleFunc("/", hub.ServeHTTP)
-	http.Handle("/ws", websocket.Handler(hub.ServeWebsocket))
-	err := http.ListenAndServe(addr, nil); 
-  restartListener <- err.Error()
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/", hub.ServeHTTP)
+	mux.HandleFunc("/ws", hub.ServeWebsocket)
+	var server = &http.Server{Addr: addr, Handler: mux}
+	var err error
+	if certificates != nil {
+		server.TLSConfig = certificates.TLSConfig()
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	restartListener <- err.Error()
+}
+
+/**
+* redirects plain http requests to https server
+*/
+func redirectServerProcess(restartListener chan string) {
+	var addr = fmt.Sprintf("%s:%d", config.Listen.Ip, config.Listen.RedirectPort);
+	l.If("redirecting to https on %s", addr)
+	err := http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if config.Listen.Port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(config.Listen.Port))
+		}
+		http.Redirect(w, r, "https://" + host + r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+	restartListener <- err.Error()
 }
 
 func main() {
+	flag.Parse()
+	var flagsSet = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { flagsSet[f.Name] = true })
+	var errors []string
+	config, errors = loadServerConfig(*configFile, flagsSet)
+	if len(errors) > 0 {
+		for _, message := range(errors) {
+			l.Ef("config: %s", message)
+		}
+		os.Exit(1)
+	}
+	if *printConfig {
+		fmt.Print(config.print())
+		return
+	}
 	path, err := os.Getwd()
 	if err != nil {
     panic(err)
@@ -33,13 +103,40 @@ func main() {
 	var processes = runtime.NumCPU()
 	runtime.GOMAXPROCS(processes)
 	l.If("using processes %d", processes)
+	var certificates *CertificateReloader
+	if config.Listen.TlsCert != "" {
+		certificates, err = NewCertificateReloader(config.Listen.TlsCert, config.Listen.TlsKey)
+		if err != nil {
+			l.Ef("could not load tls certificate: %s", err.Error())
+			os.Exit(1)
+		}
+	}
 	l.I("server started.")
 	restartLisnener := make(chan string)
-	hub := comet.NewHub()
+	redirectRestartListener := make(chan string)
+	hub := comet.NewHub(config.hubConfig())
+	config.applyLive(hub)
+	if config.Routes != "" {
+		if err = loadBackendRoutes(hub, config.Routes); err != nil {
+			l.Ef("could not load backend routes: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	hub.SetReloadHandler(func() (comet.ReloadResult, error) { return reloadConfig(hub, flagsSet) })
+	go reloadProcess(hub)
+	if certificates != nil && config.Listen.RedirectPort > 0 {
+		go func() {
+			for {
+				go redirectServerProcess(redirectRestartListener)
+				reason := <-redirectRestartListener
+				l.Wf("redirect server restarted: %s", reason)
+			}
+		}()
+	}
 	for {
-		go httpServerProcess(hub, restartLisnener)
+		go httpServerProcess(hub, certificates, restartLisnener)
 		reason := <-restartLisnener
-		l.Wf("web server restarted: %s", reason) 
+		l.Wf("web server restarted: %s", reason)
 	}
-	
+
 }
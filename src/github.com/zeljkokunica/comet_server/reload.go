@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"github.com/zeljkokunica/comet"
+)
+
+/**
+* setting compared on reload - live settings are applied to running server, others are used after restart
+*/
+type configSetting struct {
+	name string
+	live bool
+	// pointer to setting in config
+	field func(c *ServerConfig) interface{}
+}
+
+var configSettings = []configSetting{
+	{"listen", false, func(c *ServerConfig) interface{} { return &c.Listen }},
+	{"dataDir", false, func(c *ServerConfig) interface{} { return &c.DataDir }},
+	{"webRoot", false, func(c *ServerConfig) interface{} { return &c.WebRoot }},
+	{"restoreData", false, func(c *ServerConfig) interface{} { return &c.RestoreData }},
+	{"subscriberQueueSize", false, func(c *ServerConfig) interface{} { return &c.SubscriberQueueSize }},
+	{"listenerQueueSize", false, func(c *ServerConfig) interface{} { return &c.ListenerQueueSize }},
+	{"timeouts", false, func(c *ServerConfig) interface{} { return &c.Timeouts }},
+	{"limits", false, func(c *ServerConfig) interface{} { return &c.Limits }},
+	{"routes", true, func(c *ServerConfig) interface{} { return &c.Routes }},
+	{"rateLimits", true, func(c *ServerConfig) interface{} { return &c.RateLimits }},
+	{"retention", true, func(c *ServerConfig) interface{} { return &c.Retention }},
+	{"auth", true, func(c *ServerConfig) interface{} { return &c.Auth }},
+	{"cors", true, func(c *ServerConfig) interface{} { return &c.Cors }},
+	{"logLevel", true, func(c *ServerConfig) interface{} { return &c.LogLevel }},
+}
+
+/**
+* loads config again and applies changed live settings to hub
+* invalid config changes nothing, backend routes file is read again even when its name did not change
+*/
+func reloadConfig(hub *comet.Hub, flagsSet map[string]bool) (comet.ReloadResult, error) {
+	var result = comet.ReloadResult{Applied: make([]string, 0), RestartRequired: make([]string, 0)}
+	next, problems := loadServerConfig(*configFile, flagsSet)
+	if len(problems) > 0 {
+		return result, errors.New(strings.Join(problems, "; "))
+	}
+	if next.Routes != "" {
+		if err := loadBackendRoutes(hub, next.Routes); err != nil {
+			return result, err
+		}
+	} else if config.Routes != "" {
+		hub.SetBackendRoutes(nil)
+	}
+	for _, setting := range(configSettings) {
+		var current = reflect.ValueOf(setting.field(&config)).Elem()
+		var loaded = reflect.ValueOf(setting.field(&next)).Elem()
+		if reflect.DeepEqual(current.Interface(), loaded.Interface()) {
+			continue
+		}
+		if setting.live {
+			// only live settings are written, servers keep reading the rest
+			current.Set(loaded)
+			result.Applied = append(result.Applied, setting.name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, setting.name)
+		}
+	}
+	config.applyLive(hub)
+	return result, nil
+}
+
+/**
+* reloads config on SIGHUP
+*/
+func reloadProcess(hub *comet.Hub) {
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range(signals) {
+		hub.Reload()
+	}
+}
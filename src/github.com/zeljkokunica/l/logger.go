@@ -3,6 +3,7 @@ package l
 import (
 	"fmt"
 	"log"	
+	"sync/atomic"
 )
 type LogLevel struct {
 	level int
@@ -14,10 +15,18 @@ var INFO = LogLevel{1, "INFO"}
 var WARN = LogLevel{2, "WARN"}
 var ERROR = LogLevel{3, "ERROR"}
 
-var MIN_LOG_LEVEL = 0
+// changed while logging - accessed atomically
+var minLogLevel int32 = 0
+
+/**
+* messages below level (0 debug ... 3 error) are not logged
+*/
+func SetMinLogLevel(level int) {
+	atomic.StoreInt32(&minLogLevel, int32(level))
+}
 	
 func writeLog(level LogLevel, message string) {
-	if level.level >= MIN_LOG_LEVEL { 
+	if int32(level.level) >= atomic.LoadInt32(&minLogLevel) { 
 		log.Printf("[%s] %s", level.name, message)
 	}
 }
@@ -2,8 +2,12 @@
  * js client for gocomet - uses WebSocket where possible, or long poll otherwise.
  * options:
  * 	channels: array<string> - array of channel names to subscribe
- * 	onDataListener: function(command, channel, version, data) - called when data from channel is received
- * 	onSubscribed: function(id) - called when client is successfully subscribed
+ * 	onDataListener: function(command, channel, version, data, contentType, publisher, correlationId) - called when data from channel is received
+ * 		data of binary channels is ArrayBuffer over WebSocket, base64 string over LongPoll
+ * 		command "resync" means versions of channel were skipped - it carries fresh channel data (as "create"), followed by channel updates
+ * 		command "item" is an item of queue channel delivered only to this client - correlationId is the item to ack/nack
+ * 	onSubscribed: function(id, publisherId) - called when client is successfully subscribed
+ * 		publisherId (WebSocket only) is the publisher of data this client publishes, id must be kept secret
  * 	onClosed: function() - called when connection is closed
  * 	reconnect: boolean = true - reconnect if connection gets closed
  * 	crossDomain: boolean = true - make cross domain requests (cors)
@@ -11,12 +15,30 @@
  *  debug: boolean = false - debug console output
  *  ip: string - ip with port - 127.0.0.1:8080
  *  useSSL: boolean = false
+ *  jsonp: boolean = false - use jsonp for long poll requests (browsers without cors support)
+ *  mode: string = "snapshot" - subscription mode: snapshot (channel data, then new data), deltas (only new data)
+ *  	or latest (only the newest data, older undelivered data of a channel is skipped)
+ *  identity: string - presence identity, sent in "join"/"leave" commands of channels with presence enabled
+ *  metadata: string - presence metadata (usually json)
+ *  filter: string - only channel updates matching filter are received, e.g. 'symbol in ("EURUSD", "GBPUSD") and price >= 1.1'
+ *  	conditions on json fields (=, !=, <, <=, >, >=, in) joined with "and"
+ *  fields: array<string> - only these fields of json channel data are received, e.g. ["symbol", "quote.bid"]
+ *  key: string - access key, when server requires one (auth.subscribeKeys)
  * Example usage:
  * var comet = GoComet({channels: ["global"], onDataListener: onNewData});
  * 
  * public methods:
  * addChannels(channels) - subscribe to channels (array of channel names)
  * removeChannels(channels) - unsubscribe to channels (array of channel names)
+ * resync(channels) - ask for fresh data of channels (array of channel names), received as "resync"
+ * publish(channel, data, echo, callback) - publish update to channel configured with clientPublish (WebSocket only)
+ * 	echo = false - publisher does not receive its own data; received data carries publisher id of its publisher
+ * request(service, data, callback(error, reply), timeout) - send request to workers subscribed to service channel,
+ * 	reply arrives through private channel; error is {code, error} (504 on timeout)
+ * call(command, params, callback(error, response), onProgress(data)) - call backend route configured on the server
+ * 	(params is an object), upstream response is the response; progress lines arrive through private channel
+ * ack(channel, item) - confirm queue item was processed
+ * nack(channel, item, requeue) - return queue item for redelivery (requeue = false drops it)
  * connectionType() - returns WebSocket or LongPoll
  */
 
@@ -24,6 +46,12 @@ GoComet = function(options) {
 	options = options || {};
 	options.channels = options.channels || [];
 	options.ip = options.ip || window.location.host;
+	options.mode = options.mode || "snapshot";
+	options.identity = options.identity || "";
+	options.metadata = options.metadata || "";
+	options.filter = options.filter || "";
+	options.fields = (options.fields || []).join(",");
+	options.key = options.key || "";
 	if (typeof(options.reconnect) === "undefined" || options.reconnect === null) {
 		options.reconnect = true;
 	}
@@ -49,15 +77,20 @@ GoCometWS = function(options) {
 		responseHandlers = {},
 		id = null,
 		channels = [],
-		keepAliveId = null,
 		isConnecting = false,
 		channelVersion,
+		// request callbacks by correlation id
+		replyHandlers = {},
+		// backend call progress callbacks by correlation id
+		progressHandlers = {},
 		// methods
 		reconnect,
 		create,
 		onMessage,
+		onBinaryMessage,
 		send,
 		subscribe,
+		onReply,
 		_addChannels,
 		_removeChannels;
 	
@@ -82,17 +115,18 @@ GoCometWS = function(options) {
 			wsUrl = "wss://";
 		}
 		wsUrl +=  options.ip + "/ws"
+		if (options.key != "") {
+			wsUrl += "?key=" + encodeURIComponent(options.key);
+		}
 		if (options.debug) console.log("Connecting ws...");
 		if (isConnecting) {
 			return;
 		}
 		isConnecting = true;
-		if (keepAliveId) {
-			clearInterval(keepAliveId);
-		}
 		channels = options.channels;
 		
   	  	ws = new WebSocket(wsUrl);
+		ws.binaryType = "arraybuffer";
 		ws.onclose = function(evt) {
 			if (options.onClosed) {
 				options.onClosed();
@@ -100,12 +134,7 @@ GoCometWS = function(options) {
 			reconnect();
 		}
 		ws.onmessage = onMessage;
-		
-		keepAliveId = setInterval(
-			function(){
-		    	send("keepAlive", {});
-		    }, 
-		    15000);
+		// server pings the connection, browser answers with pong - no keep alive needed
 		subscribe();
 	};
 	
@@ -133,19 +162,49 @@ GoCometWS = function(options) {
 	  ws.send(requestJson);
 	};
 		  
+	// binary frame: json header, new line, raw data
+	onBinaryMessage = function(buffer) {
+		var bytes = new Uint8Array(buffer),
+			headerEnd = 0,
+			header = "",
+			i;
+		while (headerEnd < bytes.length && bytes[headerEnd] != 10) {
+			headerEnd++;
+		}
+		for (i = 0; i < headerEnd; i++) {
+			header += String.fromCharCode(bytes[i]);
+		}
+		header = JSON.parse(decodeURIComponent(escape(header)));
+		if (options.onDataListener) {
+			options.onDataListener(header.command, header.channel, header.version, buffer.slice(headerEnd + 1), header.contentType, header.publisher, header.correlationId);
+		}
+	};
+	
 	onMessage = function(evt) {
+		if (evt.data instanceof ArrayBuffer) {
+			onBinaryMessage(evt.data);
+			return;
+		}
 		var event = JSON.parse(evt.data);
 		var requestId = event.requestId;
 		if (responseHandlers[requestId]) {
-			if (responseHandlers[requestId].success) {
+			if (event.error) {
+				if (responseHandlers[requestId].fail) {
+					responseHandlers[requestId].fail(event.error);
+				}
+			}
+			else if (responseHandlers[requestId].success) {
 				responseHandlers[requestId].success(event.data);
 		    }
 		  	delete responseHandlers[requestId];
 		}
 		else {
 			jQuery.each(event.commands, function(index, data){
+				if (onReply(data)) {
+					return;
+				}
 				if (options.onDataListener) {
-					options.onDataListener(data.command, data.channel, data.version, data.data);
+					options.onDataListener(data.command, data.channel, data.version, data.data, data.contentType, data.publisher, data.correlationId);
 				}
             });
 		}
@@ -159,6 +218,26 @@ GoCometWS = function(options) {
 		send(command, paramsMap, success, error);
 	};
 	
+	// reply or error for a request sent by this client - returns true if it was handled
+	onReply = function(data) {
+		if (data.command == "progress" && progressHandlers[data.correlationId]) {
+			progressHandlers[data.correlationId](data.data);
+			return true;
+		}
+		var handler = replyHandlers[data.correlationId];
+		if (!data.correlationId || !handler || (data.command != "reply" && data.command != "error")) {
+			return false;
+		}
+		delete replyHandlers[data.correlationId];
+		if (data.command == "error") {
+			handler(JSON.parse(data.data), null);
+		}
+		else {
+			handler(null, data.data);
+		}
+		return true;
+	};
+	
 	_addChannels = function(channels) {
 		var newChannels = "";
 		jQuery.each(channels, function(index, channel){
@@ -171,7 +250,7 @@ GoCometWS = function(options) {
 		});
 		request(
 			"addchannels", 
-			[{name: "id", value: id}, {name: "channels", value: newChannels}], 
+			[{name: "id", value: id}, {name: "channels", value: newChannels}, {name: "mode", value: options.mode}, {name: "filter", value: options.filter}, {name: "fields", value: options.fields}], 
 			function(data){
 				jQuery.each(channels, function(index, channel){
 			   		channels.push(channels);
@@ -214,13 +293,13 @@ GoCometWS = function(options) {
 		});
 		request(
 			"subscribe",
-			[{name: "channels", value: channelsParam}],
+			[{name: "channels", value: channelsParam}, {name: "mode", value: options.mode}, {name: "identity", value: options.identity}, {name: "metadata", value: options.metadata}, {name: "filter", value: options.filter}, {name: "fields", value: options.fields}],
 			function(data) {
 				if (options.debug) console.log("subscribed: " + data.subscriberId);
 				id = data.subscriberId;
 				channelVersion = {};
 				if (options.onSubscribed) {
-					options.onSubscribed(id);
+					options.onSubscribed(id, data.publisherId);
 				}
 			},
 			function(){
@@ -237,6 +316,40 @@ GoCometWS = function(options) {
 		removeChannels: function(channels) {
 			_removeChannels(channels);
 		},
+		resync: function(channels) {
+			request("resync", [{name: "id", value: id}, {name: "channels", value: channels.join(",")}], null, null);
+		},
+		publish: function(channel, data, echo, callback) {
+			request("publish", [{name: "channel", value: channel}, {name: "data", value: data}, {name: "echo", value: echo !== false}], callback, null);
+		},
+		request: function(service, data, callback, timeout) {
+			var correlationId = new Date().getTime() + "_" + Math.random().toString(36).slice(2) + Math.random().toString(36).slice(2);
+			replyHandlers[correlationId] = callback;
+			request("request", [{name: "service", value: service}, {name: "data", value: data}, {name: "correlationId", value: correlationId}, {name: "timeout", value: timeout || 30000}], null, function(error) {
+				delete replyHandlers[correlationId];
+				callback(error || {code: 0, error: "request failed"}, null);
+			});
+		},
+		ack: function(channel, item) {
+			request("ack", [{name: "id", value: id}, {name: "channel", value: channel}, {name: "item", value: item}], null, null);
+		},
+		nack: function(channel, item, requeue) {
+			request("nack", [{name: "id", value: id}, {name: "channel", value: channel}, {name: "item", value: item}, {name: "requeue", value: requeue !== false}], null, null);
+		},
+		call: function(command, params, callback, onProgress) {
+			var correlationId = new Date().getTime() + "_" + Math.random().toString(36).slice(2) + Math.random().toString(36).slice(2);
+			params = jQuery.extend({correlationId: correlationId}, params);
+			if (onProgress) {
+				progressHandlers[correlationId] = onProgress;
+			}
+			send(command, params, function(response) {
+				delete progressHandlers[correlationId];
+				callback(null, response);
+			}, function(error) {
+				delete progressHandlers[correlationId];
+				callback(error || {code: 0, error: "call failed"}, null);
+			});
+		},
 		connectionType: function() {
 			return "WebSocket";
 		}
@@ -249,10 +362,15 @@ GoCometLongPoll = function(options) {
 		channels = [],
 		keepAliveId = null,
 		channelVersion,
+		// request callbacks by correlation id
+		replyHandlers = {},
+		// backend call progress callbacks by correlation id
+		progressHandlers = {},
 		// methods
 		getData,
 		request,
 		subscribe,
+		onReply,
 		_addChannels,
 		_removeChannels,
 		url = "http";
@@ -267,6 +385,9 @@ GoCometLongPoll = function(options) {
 		var paramsUrl = "";
 		// add timestamp to skip cache on IE
 		params.push({name: "__ts", value: new Date().getTime()});
+		if (options.key != "") {
+			params.push({name: "key", value: encodeURIComponent(options.key)});
+		}
 		jQuery.each(params, function(index, param){
 			if (paramsUrl != "") {
 				paramsUrl += "&";
@@ -281,11 +402,13 @@ GoCometLongPoll = function(options) {
 			url: requestUrl,
 		    context: document.body,
 		    crossDomain: options.crossDomain,
+		    dataType: options.jsonp ? "jsonp" : "text",
 		    timeout: 60000
 		 }).success(function(data, status, jqxhr) {
 			if (options.debug) console.log("Ajax response: " + data);
 			if (success) {
-				success(JSON.parse(data));
+				// jsonp response is already parsed
+				success(options.jsonp ? data : JSON.parse(data));
 			}
 		 }).error(function(qXHR, status, errorThrown){
 			if (error) {
@@ -293,6 +416,26 @@ GoCometLongPoll = function(options) {
 			}
 		 });
 	};
+	// reply or error for a request sent by this client - returns true if it was handled
+	onReply = function(data) {
+		if (data.command == "progress" && progressHandlers[data.correlationId]) {
+			progressHandlers[data.correlationId](data.data);
+			return true;
+		}
+		var handler = replyHandlers[data.correlationId];
+		if (!data.correlationId || !handler || (data.command != "reply" && data.command != "error")) {
+			return false;
+		}
+		delete replyHandlers[data.correlationId];
+		if (data.command == "error") {
+			handler(JSON.parse(data.data), null);
+		}
+		else {
+			handler(null, data.data);
+		}
+		return true;
+	};
+	
 	_addChannels = function(channels) {
 		var newChannels = "";
 		jQuery.each(channels, function(index, channel){
@@ -305,7 +448,7 @@ GoCometLongPoll = function(options) {
 		});
 		request(
 			"addchannels", 
-			[{name: "id", value: id}, {name: "channels", value: newChannels}], 
+			[{name: "id", value: id}, {name: "channels", value: newChannels}, {name: "mode", value: options.mode}, {name: "filter", value: encodeURIComponent(options.filter)}, {name: "fields", value: encodeURIComponent(options.fields)}], 
 			function(data){
 				jQuery.each(channels, function(index, channel){
 					channels.push(channels);
@@ -347,7 +490,7 @@ GoCometLongPoll = function(options) {
 		});
 		request(
 			"subscribe",
-			[{name: "channels", value: channelsParam}],
+			[{name: "channels", value: channelsParam}, {name: "mode", value: options.mode}, {name: "identity", value: encodeURIComponent(options.identity)}, {name: "metadata", value: encodeURIComponent(options.metadata)}, {name: "filter", value: encodeURIComponent(options.filter)}, {name: "fields", value: encodeURIComponent(options.fields)}],
 			function(data) {
 				id = data.subscriberId;
 				if (options.onSubscribed) {
@@ -370,8 +513,11 @@ GoCometLongPoll = function(options) {
 				// got data
 				if (result.status == "1") {
 					jQuery.each(result.commands, function(index, data){
+						if (onReply(data)) {
+							return;
+						}
 						if (options.onDataListener) {
-							options.onDataListener(data.command, data.channel, data.version, data.data);
+							options.onDataListener(data.command, data.channel, data.version, data.data, data.contentType, data.publisher, data.correlationId);
 						}
 					});
 					setTimeout(getData, 1);
@@ -401,6 +547,40 @@ GoCometLongPoll = function(options) {
 		removeChannels: function(channels) {
 			_removeChannels(channels);
 		},
+		resync: function(channels) {
+			request("resync", [{name: "id", value: id}, {name: "channels", value: channels.join(",")}], null, null);
+		},
+		request: function(service, data, callback, timeout) {
+			var correlationId = new Date().getTime() + "_" + Math.random().toString(36).slice(2) + Math.random().toString(36).slice(2);
+			replyHandlers[correlationId] = callback;
+			request("request", [{name: "id", value: id}, {name: "service", value: service}, {name: "data", value: encodeURIComponent(data)}, {name: "correlationId", value: correlationId}, {name: "timeout", value: timeout || 30000}], null, function() {
+				delete replyHandlers[correlationId];
+				callback({code: 0, error: "request failed"}, null);
+			});
+		},
+		ack: function(channel, item) {
+			request("ack", [{name: "id", value: id}, {name: "channel", value: channel}, {name: "item", value: item}], null, null);
+		},
+		nack: function(channel, item, requeue) {
+			request("nack", [{name: "id", value: id}, {name: "channel", value: channel}, {name: "item", value: item}, {name: "requeue", value: requeue !== false}], null, null);
+		},
+		call: function(command, params, callback, onProgress) {
+			var correlationId = new Date().getTime() + "_" + Math.random().toString(36).slice(2) + Math.random().toString(36).slice(2);
+			var requestParams = [{name: "id", value: id}, {name: "correlationId", value: correlationId}];
+			jQuery.each(params || {}, function(name, value) {
+				requestParams.push({name: name, value: encodeURIComponent(value)});
+			});
+			if (onProgress) {
+				progressHandlers[correlationId] = onProgress;
+			}
+			request(command, requestParams, function(response) {
+				delete progressHandlers[correlationId];
+				callback(null, response);
+			}, function() {
+				delete progressHandlers[correlationId];
+				callback({code: 0, error: "call failed"}, null);
+			});
+		},
 		connectionType: function() {
 			return "LongPoll";
 		}